@@ -0,0 +1,196 @@
+package folie
+
+// This file contains the handling of authorized keys for the SSH server.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// roleOption is the authorized keys option which sets the role of a key, for example
+	// folie-role="observe". Keys without it get the admin role.
+	roleOption = "folie-role"
+	// fingerprintExt is the permissions extension recording the fingerprint of the client key.
+	fingerprintExt = "folie-fingerprint"
+)
+
+// AuthorizedKeys holds the client keys and certificate authorities from one or more authorized
+// keys files. The files use the OpenSSH format, keys marked with a "cert-authority" option (or
+// an "@cert-authority" prefix as in known_hosts) accept certificates signed by that key. The
+// files are reloaded whenever one of them changes.
+type AuthorizedKeys struct {
+	Files []string // names of the authorized keys files
+
+	mu          sync.Mutex
+	modTimes    []time.Time     // modification times of the files when last loaded
+	keys        map[string]Role // authorized keys and their role, by marshalled key
+	authorities map[string]Role // certificate authorities and the role of their certificates
+	checker     ssh.CertChecker
+}
+
+// NewAuthorizedKeys loads a comma-separated list of authorized keys files, a leading "~/" in a
+// file name refers to the home directory.
+func NewAuthorizedKeys(files string) (*AuthorizedKeys, error) {
+	ak := &AuthorizedKeys{}
+	for _, f := range strings.Split(files, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			ak.Files = append(ak.Files, ExpandHome(f))
+		}
+	}
+	ak.checker = ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			_, ok := ak.authorities[string(auth.Marshal())]
+			return ok
+		},
+		UserKeyFallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := ak.keys[string(key.Marshal())]; ok {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %q", c.User())
+		},
+	}
+	if err := ak.Reload(); err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// ExpandHome replaces a leading "~/" by the user's home directory.
+func ExpandHome(name string) string {
+	if name == "~" || strings.HasPrefix(name, "~/") {
+		return filepath.Join(os.Getenv("HOME"), name[1:])
+	}
+	return name
+}
+
+// Reload reads all the authorized keys files. If there is an error the previously loaded keys
+// remain in effect.
+func (ak *AuthorizedKeys) Reload() error {
+	keys := map[string]Role{}
+	authorities := map[string]Role{}
+	var modTimes []time.Time
+	for _, file := range ak.Files {
+		info, err := os.Stat(file)
+		if err == nil {
+			modTimes = append(modTimes, info.ModTime())
+			err = readAuthorizedKeys(file, keys, authorities)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+	ak.keys, ak.authorities, ak.modTimes = keys, authorities, modTimes
+	return nil
+}
+
+// changed returns true if any of the files has been modified since it was last loaded.
+func (ak *AuthorizedKeys) changed() bool {
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+
+	for i, file := range ak.Files {
+		info, err := os.Stat(file)
+		if err != nil || i >= len(ak.modTimes) || !info.ModTime().Equal(ak.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate is an ssh.ServerConfig.PublicKeyCallback which accepts authorized keys and
+// certificates signed by an authorized certificate authority. The permissions it returns record
+// the role of the client and the fingerprint of its key.
+func (ak *AuthorizedKeys) Authenticate(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if ak.changed() {
+		if err := ak.Reload(); err != nil {
+			fmt.Fprintf(os.Stderr, "[ssh: %s, keeping the previous keys]\n", err)
+		}
+	}
+
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+
+	perms, err := ak.checker.Authenticate(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Work out the role, for certificates it's the one given to their authority. The
+	// permissions are copied since for certificates they belong to the certificate.
+	role := ak.keys[string(key.Marshal())]
+	if cert, ok := key.(*ssh.Certificate); ok {
+		role = ak.authorities[string(cert.SignatureKey.Marshal())]
+	}
+	ext := map[string]string{}
+	for k, v := range perms.Extensions {
+		ext[k] = v
+	}
+	ext[roleOption] = role.String() // a certificate must not be able to pick its own role
+	ext[fingerprintExt] = ssh.FingerprintSHA256(key)
+	return &ssh.Permissions{CriticalOptions: perms.CriticalOptions, Extensions: ext}, nil
+}
+
+// readAuthorizedKeys reads an authorized keys file and adds its keys and certificate
+// authorities, with their roles, to the maps.
+func readAuthorizedKeys(file string, keys, authorities map[string]Role) error {
+	authorizedKeysBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to load authorized keys from %s: %v", file, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(authorizedKeysBytes))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		isAuthority := false
+		if strings.HasPrefix(line, "@cert-authority ") {
+			isAuthority = true
+			line = line[len("@cert-authority "):]
+		}
+
+		pubKey, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("error parsing authorized keys from %s:%d: %v", file, lineNo, err)
+		}
+		role, err := keyRole(options)
+		if err != nil {
+			return fmt.Errorf("error parsing authorized keys from %s:%d: %v", file, lineNo, err)
+		}
+		for _, opt := range options {
+			isAuthority = isAuthority || opt == "cert-authority"
+		}
+
+		if isAuthority {
+			authorities[string(pubKey.Marshal())] = role
+		} else {
+			keys[string(pubKey.Marshal())] = role
+		}
+	}
+	return nil
+}
+
+// keyRole returns the role set by the options of an authorized key.
+func keyRole(options []string) (Role, error) {
+	for _, opt := range options {
+		if strings.HasPrefix(opt, roleOption+"=") {
+			name := strings.Trim(opt[len(roleOption)+1:], `"`)
+			return ParseRole(name)
+		}
+	}
+	return RoleAdmin, nil
+}
@@ -0,0 +1,101 @@
+package folie
+
+// This file contains the Boards served by a folie process, for benches with several
+// microcontrollers attached.
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Board is one of the microcontrollers served by folie, with its own connection and switchboard,
+// so each board has its own lock, clients, and !watch.
+type Board struct {
+	Name  string          // label used by clients to select the board
+	Port  string          // where the board is attached, as given to -p
+	SW    *Switchboard    // switchboard of the board, its MicroOutput is the connection
+	Input chan<- NetInput // network input of the switchboard
+}
+
+// Boards is the list of boards served by folie, the first one is the default, it's also the one
+// the local console talks to.
+type Boards []*Board
+
+// ParseBoards splits a comma-separated list of ports, each optionally preceded by a label and an
+// equal sign, e.g. "f103-a=/dev/ttyUSB0,f103-b=/dev/ttyUSB1". Ports without label are named after
+// them using BoardName. The switchboards are left for the caller to fill in.
+func ParseBoards(ports string) (Boards, error) {
+	var boards Boards
+	for _, port := range strings.Split(ports, ",") {
+		name := ""
+		if i := strings.Index(port, "="); i >= 0 {
+			name, port = port[:i], port[i+1:]
+		}
+		if port == "" {
+			return nil, fmt.Errorf("missing port in %q", ports)
+		}
+		if name == "" {
+			name = BoardName(port)
+		}
+		if boards.Find(name) != nil {
+			return nil, fmt.Errorf("duplicate board name %q, use <name>=<port>", name)
+		}
+		boards = append(boards, &Board{Name: name, Port: port})
+	}
+	return boards, nil
+}
+
+// BoardName returns the default name of a board attached to port: the last element of device
+// paths, such as those in /dev/serial/by-id/, and the port itself for remote serial ports.
+func BoardName(port string) string {
+	if strings.HasPrefix(port, "/") || strings.HasPrefix(strings.ToUpper(port), "COM") {
+		return filepath.Base(port)
+	}
+	return port
+}
+
+// Find returns the board with the specified name, or nil if there is none.
+func (bs Boards) Find(name string) *Board {
+	for _, b := range bs {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// of returns the board using the specified switchboard, or nil if there is none.
+func (bs Boards) of(sw *Switchboard) *Board {
+	for _, b := range bs {
+		if b.SW == sw {
+			return b
+		}
+	}
+	return nil
+}
+
+// State describes what the board is up to, for listing it to clients.
+func (b *Board) State() string {
+	b.SW.mu.Lock()
+	conn, lockedBy, clients := b.SW.connState, b.SW.lockedBy, len(b.SW.consoleOutput)
+	b.SW.mu.Unlock()
+
+	state := "free"
+	if lockedBy != "" {
+		state = "locked by " + lockedBy
+	}
+	return fmt.Sprintf("%s, %s, %d clients", conn, state, clients)
+}
+
+// List writes a line for each board, marking the default one.
+func (bs Boards) List(w io.Writer) {
+	for i, b := range bs {
+		mark := " "
+		if i == 0 {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s %-16s %-32s %s\n", mark, b.Name, b.Port, b.State())
+	}
+}
@@ -14,8 +14,13 @@ import (
 
 var origStdErr = os.Stderr
 
-// NewReadline creates a readline instance on stdin/out.
+// NewReadline creates a readline instance on stdin/out, with the function keys of KeyBindings.
 func NewReadline() (*readline.Instance, error) {
+	filter, err := keyFilter()
+	if err != nil {
+		return nil, err
+	}
+
 	// The terminal is put into raw mode, which causes stdout and stderr not to get the usual
 	// CR-LF treatment. This means we need to add CRs ourselves.
 
@@ -30,6 +35,10 @@ func NewReadline() (*readline.Instance, error) {
 		UniqueEditLine:    true, // erase input after submitting
 		HistorySearchFold: true, // case insensitive history
 		AutoComplete:      FileCompleter{},
+
+		// Readline drops the escape sequences of function keys, so they're translated first.
+		Stdin:               readline.NewCancelableStdin(&keyReader{r: readline.Stdin}),
+		FuncFilterInputRune: filter,
 	}
 	rdl, err := readline.NewEx(&config)
 	if err != nil {
@@ -58,6 +67,13 @@ func RunConsole(rdl *readline.Instance, rx chan<- []byte, done chan error) {
 		}
 	}()
 
+	// Goroutine to send the lines entered using key bindings.
+	go func() {
+		for line := range keyLines {
+			rx <- []byte(line + "\n")
+		}
+	}()
+
 }
 
 // insertCRs is used to insert lost CRs when readline is active.
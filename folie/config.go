@@ -0,0 +1,325 @@
+package main
+
+// The config file, which defines named profiles holding the settings for each board.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/tve/folie"
+)
+
+// localConfig is the project-local config file, its settings take precedence over the ones in
+// the user's config file. It may come with an untrusted checkout, so its profiles can only have
+// the localSettings, which can't open network listeners nor run anything unasked. For the same
+// reason it can't define macros nor key bindings, which run ! commands.
+const localConfig = ".folie"
+
+// localSettings lists the profile settings allowed in the project-local config file.
+var localSettings = map[string]bool{
+	"port": true, "serial": true, "baud": true, "transport": true, "dialect": true,
+	"strip": true, "join": true, "window": true, "firmware": true, "include": true,
+	"banner": true,
+}
+
+// config is the contents of the config files, for example:
+//
+//	default = "f103"
+//
+//	[profile.f103]
+//	serial = "55FF6B065177495619420887"
+//	transport = "raw"
+//	dialect = "mecrisp"
+//	firmware = "~/firmware/mecrisp-f103.bin"
+//	include = ["~/forth/flib"]
+//	startup = ["!send always.fs"]
+//	on_upload = ["!send flib/base.fs"]
+//	on_reset = ["init-board"]
+//	banner = "Mecrisp-Stellaris"
+//
+//	[macro]
+//	w = "words"
+//	flash = ["compiletoflash", "!send {1}", "compiletoram"]
+//
+//	[keys]
+//	F2 = "!flash app.fs"
+type config struct {
+	Default  string                `toml:"default"` // profile to use when there is no -profile
+	Profiles map[string]*profile   `toml:"profile"`
+	Macros   map[string]macroLines `toml:"macro"` // ! commands, see folie.Switchboard.Macros
+	Keys     map[string]string     `toml:"keys"`  // lines entered by function keys, "" to unbind
+}
+
+// macroLines holds the lines of a macro, they can be given as a single string or as a list.
+// Lines which start with ! are commands, the others are sent to the board. In both, {1} to {9}
+// stand for the arguments of the macro, {*} for all of them.
+type macroLines []string
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (ml *macroLines) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*ml = macroLines{v}
+		return nil
+	case []interface{}:
+		for _, line := range v {
+			s, ok := line.(string)
+			if !ok {
+				return fmt.Errorf("macro lines must be strings")
+			}
+			*ml = append(*ml, s)
+		}
+		return nil
+	}
+	return fmt.Errorf("macro must be a string or a list of strings")
+}
+
+// profile holds the settings for a board. Those which correspond to command-line flags are only
+// used if the flag isn't given.
+type profile struct {
+	Port      string `toml:"port"`      // same as -p
+	Serial    string `toml:"serial"`    // same as -serial
+	Baud      int    `toml:"baud"`      // same as -b
+	Transport string `toml:"transport"` // "raw", "telnet", or "ssh", then port is the remote folie
+	Dialect   string `toml:"dialect"`   // preset for strip, join, and window, see dialects
+
+	Strip  *bool `toml:"strip"`  // same as -strip, can be set to false to override the dialect
+	Join   int   `toml:"join"`   // same as -join
+	Window int   `toml:"window"` // same as -window
+
+	Listen string `toml:"listen"` // same as -l
+	Key    string `toml:"key"`    // same as -key
+	Auth   string `toml:"auth"`   // same as -auth
+	Files  string `toml:"files"`  // same as -files
+	HTTP   string `toml:"http"`   // same as -http
+
+	Firmware string   `toml:"firmware"` // default firmware for "!u 0"
+	Include  []string `toml:"include"`  // directories to search for included files
+	Startup  []string `toml:"startup"`  // lines sent to the console once connected
+	Scripts  []string `toml:"scripts"`  // same as -script
+
+	// Hooks, each is a list of ! commands and lines of forth source, see folie.Hooks.
+	OnConnect []string `toml:"on_connect"` // after (re)connecting to the board
+	OnReset   []string `toml:"on_reset"`   // after a reset
+	OnUpload  []string `toml:"on_upload"`  // after uploading firmware
+	Banner    string   `toml:"banner"`     // regexp matching the reset banner, to detect resets
+}
+
+// dialect holds the settings which suit a forth implementation.
+type dialect struct {
+	strip  bool
+	join   int
+	window int
+}
+
+// dialects lists the forth implementations which have presets.
+var dialects = map[string]dialect{
+	"mecrisp": {strip: true, join: 200, window: 1}, // lines up to the size of the input buffer
+}
+
+// configDir returns the directory with the user's folie config file, which is in
+// $XDG_CONFIG_HOME/folie, or ~/.config/folie by default.
+func configDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "folie")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "folie")
+}
+
+// loadConfig reads the user's config file and then the project-local one. Profiles, macros, and
+// keys in the local file replace those with the same name. Missing files are skipped, unknown
+// settings are reported as errors, since they are most likely typos, as are settings not allowed
+// in the local file.
+func loadConfig() (*config, error) {
+	cfg := &config{Profiles: map[string]*profile{}, Macros: map[string]macroLines{},
+		Keys: map[string]string{}}
+	for _, file := range []string{filepath.Join(configDir(), "config.toml"), localConfig} {
+		var c config
+		md, err := toml.DecodeFile(file, &c)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown setting %s", file, undecoded[0])
+		}
+		if file == localConfig {
+			for _, key := range md.Keys() {
+				if key[0] == "macro" || key[0] == "keys" ||
+					len(key) == 3 && key[0] == "profile" && !localSettings[key[2]] {
+					return nil, fmt.Errorf("%s: %s is only allowed in %s", file, key,
+						filepath.Join(configDir(), "config.toml"))
+				}
+			}
+		}
+		for name, p := range c.Profiles {
+			if p.Port != "" && p.Serial != "" {
+				return nil, fmt.Errorf("%s: profile %s sets both port and serial, use one",
+					file, name)
+			}
+		}
+		if c.Default != "" {
+			cfg.Default = c.Default
+		}
+		for name, p := range c.Profiles {
+			cfg.Profiles[name] = p
+		}
+		for name, m := range c.Macros {
+			cfg.Macros[strings.TrimPrefix(name, "!")] = m
+		}
+		for key, line := range c.Keys {
+			cfg.Keys[key] = line
+		}
+	}
+	return cfg, nil
+}
+
+// profile returns the named profile, or the default one if name is empty. It returns nil if
+// there is no profile to use.
+func (cfg *config) profile(name string) (*profile, error) {
+	if name == "" {
+		name = cfg.Default
+		if name == "" {
+			return nil, nil
+		}
+	}
+	p := cfg.Profiles[name]
+	if p == nil {
+		var names []string
+		for n := range cfg.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q, the config files define: %s", name,
+			strings.Join(names, " "))
+	}
+	return p, nil
+}
+
+// flags returns the command-line flags corresponding to the settings of the profile, as they
+// would be given on the command line.
+func (p *profile) flags() (map[string]string, error) {
+	f := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			f[name] = value
+		}
+	}
+
+	switch p.Transport {
+	case "", "telnet":
+		set("p", p.Port)
+	case "raw":
+		set("p", p.Port)
+		set("r", "true")
+	case "ssh":
+		set("ssh", p.Port)
+	default:
+		return nil, fmt.Errorf("unknown transport %q, use raw, telnet, or ssh", p.Transport)
+	}
+	set("serial", p.Serial)
+	if p.Baud != 0 {
+		set("b", strconv.Itoa(p.Baud))
+	}
+
+	if p.Dialect != "" {
+		d, ok := dialects[p.Dialect]
+		if !ok {
+			return nil, fmt.Errorf("unknown dialect %q", p.Dialect)
+		}
+		set("strip", strconv.FormatBool(d.strip))
+		set("join", strconv.Itoa(d.join))
+		set("window", strconv.Itoa(d.window))
+	}
+	if p.Strip != nil {
+		set("strip", strconv.FormatBool(*p.Strip))
+	}
+	if p.Join != 0 {
+		set("join", strconv.Itoa(p.Join))
+	}
+	if p.Window != 0 {
+		set("window", strconv.Itoa(p.Window))
+	}
+
+	set("l", p.Listen)
+	set("key", p.Key)
+	set("auth", p.Auth)
+	set("files", p.Files)
+	set("http", p.HTTP)
+	set("script", strings.Join(p.Scripts, ","))
+	return f, nil
+}
+
+// hooks returns the hooks of the profile.
+func (p *profile) hooks() (folie.Hooks, error) {
+	h := folie.Hooks{Connect: p.OnConnect, Reset: p.OnReset, Upload: p.OnUpload}
+	if p.Banner != "" {
+		var err error
+		if h.Banner, err = regexp.Compile(p.Banner); err != nil {
+			return h, fmt.Errorf("banner in profile: %s", err)
+		}
+	}
+	return h, nil
+}
+
+// reloadConfig reads the config files again and passes the macros and the hooks of the named
+// profile on to the boards. The other settings correspond to flags, which only apply at startup.
+func reloadConfig(boards folie.Boards, profileName string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	p, err := cfg.profile(profileName)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		p = &profile{}
+	}
+	hooks, err := p.hooks()
+	if err != nil {
+		return err
+	}
+	macros := map[string][]string{}
+	for name, lines := range cfg.Macros {
+		macros[name] = lines
+	}
+	for _, b := range boards {
+		b.SW.Reconfigure(hooks, macros)
+	}
+	return nil
+}
+
+// applyProfile sets the flags which weren't given on the command line from the profile. The
+// flags which select the board are treated as a group: if any of them is given, the profile
+// doesn't get to pick another board.
+func applyProfile(p *profile) error {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	boardGiven := given["p"] || given["serial"] || given["ssh"] || given["replay"]
+
+	flags, err := p.flags()
+	if err != nil {
+		return err
+	}
+	for name, value := range flags {
+		switch {
+		case given[name]:
+		case boardGiven && (name == "p" || name == "serial" || name == "ssh" || name == "r"):
+		default:
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("%s in profile: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestMacroLines(t *testing.T) {
+	tests := []struct {
+		toml string
+		want string // lines joined by "|", or the error
+	}{
+		{`m = "1 2 + ."`, "1 2 + ."},
+		{`m = ""`, ""},
+		{`m = ["!reset", "!send {1}"]`, "!reset|!send {1}"},
+		{`m = ["only one"]`, "only one"},
+		{`m = []`, ""},
+		{`m = 42`, "macro must be a string or a list of strings"},
+		{`m = ["ok", 1]`, "macro lines must be strings"},
+		{`m = { x = "y" }`, "macro must be a string or a list of strings"},
+	}
+	for _, tt := range tests {
+		var c struct {
+			M macroLines `toml:"m"`
+		}
+		_, err := toml.Decode(tt.toml, &c)
+		got := strings.Join(c.M, "|")
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.Contains(got, tt.want) || err == nil && got != tt.want {
+			t.Errorf("decoding %s = %q, want %q", tt.toml, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// Signal handling for -daemon mode, where folie runs headless as a shared server, e.g. under
+// systemd.
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tve/folie"
+)
+
+// runDaemon serves network clients until SIGTERM or SIGINT arrives, then closes the logs and the
+// connections to the microcontrollers and exits. SIGHUP reloads the authorized keys of the SSH
+// server, if there is one, and calls reload to reread the config file. Key bindings aren't
+// reloaded, since a daemon has no console to press keys on. If reconnecting to all the boards
+// has been given up, it exits with an error, so a service manager can step in.
+func runDaemon(boards folie.Boards, sshServer *folie.SSHServer, reload func() error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+	for {
+		select {
+		case <-check.C:
+			if gaveUp(boards) {
+				fmt.Fprintln(os.Stderr, "[gave up on all boards, exiting]")
+				shutdown(boards)
+				os.Exit(3)
+			}
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				fmt.Fprintf(os.Stderr, "[shutting down: %s]\n", sig)
+				shutdown(boards)
+				os.Exit(0)
+			}
+			if sshServer != nil && sshServer.AuthKeys != nil {
+				if err := sshServer.AuthKeys.Reload(); err != nil {
+					fmt.Fprintf(os.Stderr, "[reload failed: %s]\n", err)
+				} else {
+					fmt.Fprintln(os.Stderr, "[reloaded authorized keys]")
+				}
+			}
+			if err := reload(); err != nil {
+				fmt.Fprintf(os.Stderr, "[reload failed: %s]\n", err)
+			} else {
+				fmt.Fprintln(os.Stderr, "[reloaded config]")
+			}
+		}
+	}
+}
+
+// gaveUp returns true if reconnecting to each of the boards has been given up.
+func gaveUp(boards folie.Boards) bool {
+	for _, b := range boards {
+		if b.SW.ConnState() != folie.GaveUp {
+			return false
+		}
+	}
+	return true
+}
+
+// shutdown closes the logs and the connections of all the boards.
+func shutdown(boards folie.Boards) {
+	for _, b := range boards {
+		b.SW.CloseLog()
+		b.SW.MicroOutput.Close()
+	}
+}
+
+// eventLog is a Tap which logs the events of a board, such as connection changes and uploads, on
+// stderr, since a daemon has no console to show them on.
+type eventLog struct{ board string }
+
+func (el eventLog) Tap(dir byte, src string, buf []byte) {
+	if dir == folie.Event {
+		fmt.Fprintf(os.Stderr, "[%s: %s %s]\n", el.board, src, buf)
+	}
+}
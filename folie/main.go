@@ -7,10 +7,12 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/chzyer/readline"
 	"github.com/tve/folie"
 )
 
@@ -21,27 +23,175 @@ func main() {
 
 	// Deal with commandline flags
 	var (
-		verbose = flag.Bool("v", false, "verbose output for debugging")
-		listen  = flag.String("l", "",
+		verbose     = flag.Bool("v", false, "verbose output for debugging")
+		profileName = flag.String("profile", "",
+			"use the settings of this profile in ~/.config/folie/config.toml or ./.folie, "+
+				"flags given on the command line override them")
+		include = flag.String("include", "",
+			"comma-separated directories to search for included files not found next to "+
+				"the file including them")
+		daemon = flag.Bool("daemon", false,
+			"run headless without a console, serving SSH and HTTP clients until SIGTERM, "+
+				"SIGHUP reloads the authorized keys and the macros and hooks of the config file; "+
+				"requires -p, -ssh, or -replay")
+		listen = flag.String("l", "",
 			"IP address and port to listen for SSH connections, e.g. 0.0.0.0:2022")
-		serverKey = flag.String("key", "/etc/ssh/ssh_host_dsa_key",
-			"SSH host key for folie to use")
+		serverKey = flag.String("key", "",
+			"SSH host key for folie to use, by default an Ed25519 key is generated on first use "+
+				"and kept in $XDG_STATE_HOME/folie (~/.local/state/folie)")
 		authorizedKeys = flag.String("auth", ".authorized_keys",
-			"SSH authorized client keys, the value \"insecure\" can be used to disable auth, "+
-				"which can be useful when listening on localhost")
-		port = flag.String("p", "", "serial port (COM*, /dev/cu.*, /dev/tty*, or hostname:port)")
+			"SSH authorized client keys, comma-separated files which are reloaded when "+
+				"changed, the value \"insecure\" can be used to disable auth, "+
+				"which can be useful when listening on localhost; a folie-role=\"observe\" or "+
+				"\"operate\" option on a key restricts it, the default is \"admin\"; "+
+				"@cert-authority keys accept certificates they signed")
+		httpAddr = flag.String("http", "",
+			"IP address and port to listen for HTTP API requests, e.g. 0.0.0.0:8022")
+		httpToken = flag.String("token", os.Getenv("FOLIE_TOKEN"),
+			"with -http, bearer token clients must send, defaults to $FOLIE_TOKEN; without it "+
+				"clients can't upload forth nor flash, and -http must be on localhost, unless "+
+				"the value is \"insecure\"")
+		files = flag.String("files", "",
+			"directory SSH clients can access via SFTP, the flash and forth commands "+
+				"then also take the name of a file in it, e.g. \"ssh -p 2022 host forth app.fs\"; "+
+				"include lines in HTTP /forth requests and the include and upload of scripts "+
+				"refer to files in it, scripts use the current directory without it")
+		port = flag.String("p", "",
+			"serial port (COM*, /dev/cu.*, /dev/tty*, or hostname:port), or a comma-separated "+
+				"list of [name=]port to serve several boards, SSH clients select one by user "+
+				"name, e.g. \"ssh f103-a@bench\", or first exec argument; \"ssh bench list\" "+
+				"shows them all; the local console and -record use the first one")
+		serialNum = flag.String("serial", "",
+			"select the USB serial port by serial number instead of using -p, a comma-separated "+
+				"list of [name=]number selects several boards")
 		baud = flag.Int("b", 115200, "serial baud rate")
-		raw  = flag.Bool("r", false, "use raw instead of telnet protocol")
-		ssh  = flag.String("ssh", "", "ssh address:port to connect to")
+		raw  = flag.Bool("r", false, "use raw instead of telnet protocol, this is automatic for "+
+			"known adapters without telnet escapes, such as CP2102, CH340, FTDI, and BMP")
+		ssh = flag.String("ssh", "",
+			"remote folie to connect to via SSH, [user@]host[:port] or a Host from ~/.ssh/config")
+		identity = flag.String("i", "",
+			"with -ssh, private key file to authenticate with, in addition to ssh-agent")
+		strip = flag.Bool("strip", false,
+			"strip comments and extra whitespace from forth source before sending it")
+		join = flag.Int("join", 0,
+			"with -strip, join short lines up to this length, e.g. 200 for Mecrisp's input buffer")
+		giveUp = flag.Duration("giveup", 10*time.Minute,
+			"with -daemon, test, or run, stop reconnecting to a board after this long, 0 to keep trying; "+
+				"a daemon exits once it has given up on all boards")
+		logFile = flag.String("log", "", "log all traffic with timestamps to this file")
+		logSize = flag.Int64("logsize", 10, "rotate the -log file when it reaches this many MB")
+		record  = flag.String("record", "", "record the session to this file, for use with -replay")
+		replay  = flag.String("replay", "", "play back a recorded session instead of using a port")
+		speed   = flag.Float64("speed", 1, "with -replay, playback speed relative to real time")
+		window  = flag.Int("window", 1,
+			"number of source lines to send before waiting for a reply, if the target allows it")
+		scripts = flag.String("script", "",
+			"Starlark scripts to start in the background once connected, comma-separated, "+
+				"they get the first board as default, see \"!script\"")
+		expand = flag.String("expand", "",
+			"expand includes in a forth source file without sending it, then exit")
+		expandOut    = flag.String("o", "", "with -expand, write to this file instead of stdout")
+		expandOrigin = flag.Bool("origin", false,
+			"with -expand, precede each line by a \"\\ file:line\" comment")
 	)
 
 	flag.Parse()
 
+	// Fill in the flags which were not given from the profile in the config files.
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	prof, err := cfg.profile(*profileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if prof == nil {
+		prof = &profile{}
+	} else if err := applyProfile(prof); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for key, line := range cfg.Keys {
+		folie.KeyBindings[strings.ToUpper(key)] = line
+	}
+	macros := map[string][]string{}
+	for name, lines := range cfg.Macros {
+		macros[name] = lines
+	}
+
 	folie.Verbose = *verbose
+	folie.StripSource = *strip
+	folie.JoinWidth = *join
+	folie.LinesInFlight = *window
+	folie.LogSize = *logSize << 20
+	transport := prof.Transport // "telnet" turns off the automatic raw mode of known adapters
+	if *raw {
+		transport = "raw"
+	}
+	if *include != "" {
+		prof.Include = append(strings.Split(*include, ","), prof.Include...)
+	}
+	for _, dir := range prof.Include {
+		folie.IncludePath = append(folie.IncludePath, folie.ExpandHome(dir))
+	}
+	if *daemon || flag.Arg(0) == "test" || flag.Arg(0) == "run" {
+		folie.ReconnectLimit = *giveUp // interactive sessions keep trying, the user can quit
+	}
 
-	// Set-up readline on the interactive terminal.
-	rdl, err := folie.NewReadline()
-	if err != nil {
+	// A dry run of sending a file doesn't need a console nor a target.
+	if *expand != "" {
+		if err := folie.ExpandFile(*expand, *expandOut, *expandOrigin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Look up the ports of boards specified by their serial number.
+	if *serialNum != "" {
+		if *port != "" {
+			fmt.Fprintln(os.Stderr, "-p and -serial cannot be combined")
+			os.Exit(1)
+		}
+		var err error
+		if *port, err = portsBySerial(*serialNum); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// Running unit tests doesn't involve the console either, nor does running a script.
+	if cmd := flag.Arg(0); cmd == "test" || cmd == "run" {
+		p, err := singlePort(*port)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err)
+			osExit(1)
+		}
+		micro := newMicro(p, transport, *baud)
+		if cmd == "test" {
+			osExit(runTests(micro, flag.Args()[1:]))
+		}
+		osExit(runScript(micro, flag.Args()[1:]))
+	}
+
+	// Set-up readline on the interactive terminal, unless running as a daemon. A daemon has
+	// nobody to ask questions, so it must be told where to connect, and its output goes
+	// straight to stdout/stderr, without readline's CR-inserting pipes.
+	var rdl *readline.Instance
+	if *daemon {
+		if *port == "" && *ssh == "" && *replay == "" {
+			fmt.Fprintln(os.Stderr, "-daemon requires -p, -ssh, or -replay")
+			os.Exit(1)
+		}
+		if *listen == "" && *httpAddr == "" {
+			fmt.Fprintln(os.Stderr, "-daemon requires -l or -http, else nobody can connect")
+			os.Exit(1)
+		}
+	} else if rdl, err = folie.NewReadline(); err != nil {
 		fmt.Fprintf(os.Stderr, "error initializing readline: %s\n", err)
 		osExit(1)
 	}
@@ -50,20 +200,20 @@ func main() {
 	var sshClient *folie.SSHClient
 	if *ssh != "" {
 		if *port != "" {
-			fmt.Fprintln(os.Stderr, "-p and -ssh cannot be combined\n")
+			fmt.Fprintln(os.Stderr, "-p and -ssh cannot be combined")
 			osExit(1)
 		}
 		if *listen != "" {
-			fmt.Fprintln(os.Stderr, "-listen and -ssh cannot be combined\n")
+			fmt.Fprintln(os.Stderr, "-listen and -ssh cannot be combined")
 			osExit(1)
 		}
-		sshClient, err = folie.NewSSHClient(*ssh)
+		sshClient, err = folie.NewSSHClient(*ssh, *identity, rdl)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			osExit(1)
 		}
 
-	} else {
+	} else if *replay == "" {
 		if *port == "" {
 			*port = folie.SelectPort(rdl)
 		}
@@ -83,48 +233,132 @@ func main() {
 			fmt.Fprintf(os.Stderr, "SSH server %s", err)
 			osExit(2)
 		}
+		if *files != "" {
+			if sshServer.Files, err = filepath.Abs(*files); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				osExit(2)
+			}
+		}
 	}
 
-	// Start the goroutines for the local interactive console.
-	done := make(chan error)
-	consoleInput := make(chan []byte, 1)
-	folie.RunConsole(rdl, consoleInput, done)
+	// Decide whether to offer the HTTP API.
+	var httpServer *folie.HTTPServer
+	if *httpAddr != "" {
+		var err error
+		if httpServer, err = folie.NewHTTPServer(*httpAddr, *httpToken); err != nil {
+			fmt.Fprintf(os.Stderr, "HTTP server %s\n", err)
+			osExit(2)
+		}
+		if *files != "" {
+			if httpServer.Files, err = filepath.Abs(*files); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				osExit(2)
+			}
+		}
+	}
+
+	hooks, err := prof.hooks()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		osExit(1)
+	}
 
-	// Open the microcontroller serial port or telnet connection and start goroutines.
-	var micro folie.MicroConn
+	// Set up the boards, there can be several if -p lists more than one port.
+	var boards folie.Boards
 	if sshClient != nil {
-		micro = sshClient
-	} else if _, err := os.Stat(*port); err == nil {
-		if *raw {
-			// Raw serial port controlled using DTR/RTS/...
-			micro = &folie.SerialConn{Path: *port, Baud: *baud}
+		boards = folie.Boards{{Name: *ssh, Port: *ssh}}
+	} else if *replay != "" {
+		boards = folie.Boards{{Name: filepath.Base(*replay), Port: *replay}}
+	} else if boards, err = folie.ParseBoards(*port); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		osExit(1)
+	}
+
+	// Open the microcontroller serial ports or telnet connections and start goroutines.
+	scriptHost := &folie.StarlarkHost{Boards: boards}
+	if *files != "" {
+		if scriptHost.Files, err = filepath.Abs(*files); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			osExit(2)
+		}
+	}
+	for _, b := range boards {
+		var micro folie.MicroConn
+		if sshClient != nil {
+			micro = sshClient
+		} else if *replay != "" {
+			micro = &folie.ReplayConn{Path: *replay, Speed: *speed}
 		} else {
-			// Serial port with Serplu controlled via telnet escapes.
-			micro = &folie.TelnetConn{Path: *port}
+			micro = newMicro(b.Port, transport, *baud)
 		}
-	} else {
-		// Remote serial port across the network.
-		micro = &folie.TelnetConn{Addr: *port}
+		microInput := make(chan []byte, 1)
+		connEvents := make(chan folie.ConnEvent, 1)
+		if err := folie.MicroConnRunner(micro, microInput, connEvents); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			osExit(3)
+		}
+		networkInput := make(chan folie.NetInput, 1)
+		b.SW = folie.NewSwitchboard(&folie.Switchboard{MicroInput: microInput, MicroOutput: micro,
+			NetworkInput: networkInput, ConnEvents: connEvents,
+			AssetNames: AssetNames(), Asset: Asset, Firmware: folie.ExpandHome(prof.Firmware),
+			Hooks: hooks, Scripts: scriptHost, Macros: macros})
+		b.Input = networkInput
 	}
-	microInput := make(chan []byte, 1)
-	if err := folie.MicroConnRunner(micro, microInput); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		osExit(3)
+
+	// Start the goroutines for the local interactive console, this is done after opening the
+	// connection since that may need to ask the user, e.g. to accept an SSH host key. The
+	// console talks to the first board.
+	done := make(chan error)
+	consoleInput := make(chan []byte, 1)
+	if rdl != nil {
+		folie.RunConsole(rdl, consoleInput, done)
+		boards[0].SW.ConsoleInput = consoleInput
+		boards[0].SW.AddConsoleOutput(os.Stdout) // a daemon logs traffic using -log instead
 	}
 
-	// Start the switchboard in the middle.
-	networkInput := make(chan folie.NetInput, 1)
-	sw := folie.Switchboard{MicroInput: microInput, MicroOutput: micro,
-		ConsoleInput: consoleInput, NetworkInput: networkInput,
-		AssetNames: AssetNames(), Asset: Asset}
-	sw.AddConsoleOutput(os.Stdout)
-	go sw.Run()
+	// Start the switchboards in the middle.
+	for _, b := range boards {
+		if *logFile != "" {
+			if err := b.SW.OpenLog(logPath(*logFile, b, len(boards)), folie.LogSize); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				osExit(1)
+			}
+		}
+	}
+	if *record != "" {
+		rec, err := folie.NewRecorder(*record)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			osExit(1)
+		}
+		boards[0].SW.AddTap(rec)
+	}
+	for _, b := range boards {
+		if *daemon {
+			b.SW.AddTap(eventLog{b.Name})
+		}
+		go b.SW.Run()
+	}
 
 	if sshServer != nil {
-		go sshServer.Run(networkInput, func(w io.Writer) { sw.AddConsoleOutput(w) })
+		go sshServer.Run(boards)
+	}
+	if httpServer != nil {
+		go httpServer.Run(boards)
 	}
 
 	fmt.Fprintln(os.Stderr, "[Ready!]")
+	go func() {
+		startup(boards, prof.Startup)
+		for _, name := range strings.Split(*scripts, ",") {
+			if name != "" {
+				scriptHost.Start(folie.ExpandHome(name), boards[0], folie.RoleAdmin)
+			}
+		}
+	}()
+	if *daemon {
+		runDaemon(boards, sshServer, func() error { return reloadConfig(boards, *profileName) })
+	}
 	if err, ok := <-done; ok {
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -134,6 +368,88 @@ func main() {
 	}
 }
 
+// startup sends the startup lines of the profile to each board, as if they were typed on the
+// console, so they can also be ! commands.
+func startup(boards folie.Boards, lines []string) {
+	for _, b := range boards {
+		for _, line := range lines {
+			done := make(chan struct{})
+			b.Input <- folie.NetInput{What: folie.CommandIn, Buf: []byte(line + "\n"),
+				From: "startup", Reply: os.Stdout, Done: done, Role: folie.RoleAdmin}
+			<-done
+		}
+	}
+}
+
+// logPath returns the name of the -log file for a board. With several boards, each gets its own
+// file, named after the board.
+func logPath(path string, b *folie.Board, count int) string {
+	if count == 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == ':' {
+			return '_'
+		}
+		return r
+	}, b.Name)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
+// singlePort returns the port of the one board selected by -p or -serial, for the subcommands.
+func singlePort(ports string) (string, error) {
+	if ports == "" {
+		return "", fmt.Errorf("no port specified, use -p or -serial")
+	}
+	boards, err := folie.ParseBoards(ports)
+	if err != nil {
+		return "", err
+	}
+	if len(boards) > 1 {
+		return "", fmt.Errorf("%d boards selected, only one can be used", len(boards))
+	}
+	return boards[0].Port, nil
+}
+
+// portsBySerial turns a list of [name=]serial-number into a list of name=port for -p.
+func portsBySerial(serials string) (string, error) {
+	var ports []string
+	for _, sn := range strings.Split(serials, ",") {
+		name := sn + "=" // boards are named after their serial number by default
+		if i := strings.Index(sn, "="); i >= 0 {
+			name, sn = sn[:i+1], sn[i+1:]
+		}
+		p, err := folie.FindSerial(sn)
+		if err != nil {
+			return "", err
+		}
+		ports = append(ports, name+p.Name)
+	}
+	return strings.Join(ports, ","), nil
+}
+
+// newMicro returns a MicroConn for a local serial port or a remote serial port. The transport is
+// "raw", "telnet", or empty, in which case known adapters which don't support telnet escapes are
+// switched to raw mode automatically.
+func newMicro(port, transport string, baud int) folie.MicroConn {
+	if _, err := os.Stat(port); err != nil {
+		// Remote serial port across the network.
+		return &folie.TelnetConn{Addr: port}
+	}
+	raw := transport == "raw"
+	if p := folie.FindPort(port); p != nil && p.Adapter != "" && transport == "" {
+		fmt.Fprintf(os.Stderr, "[%s: %s adapter]\n", port, p.Adapter)
+		raw = p.Raw
+	}
+	if raw {
+		// Raw serial port controlled using DTR/RTS/...
+		return &folie.SerialConn{Path: port, Baud: baud}
+	}
+	// Serial port with Serplu controlled via telnet escapes.
+	return &folie.TelnetConn{Path: port}
+}
+
 // osExit calls os.Exit after a small sleep to let stdout/stderr output drain. This is necessary
 // because of the loop-back pipe for the InsertCR stuff... Ouch.
 func osExit(code int) {
@@ -0,0 +1,40 @@
+package main
+
+// The "run" subcommand, which runs a script against the attached microcontroller.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tve/folie"
+)
+
+// runScript parses the run subcommand's flags and runs the script. It returns the exit code: 0
+// if the script completed, 1 if it failed, and 2 if it could not be run.
+func runScript(micro folie.MicroConn, args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: folie -p <port> run [flags] <script>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	microInput := make(chan []byte, 1)
+	if err := folie.MicroConnRunner(micro, microInput, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	s := &folie.Script{Tx: micro, Rx: microInput, Out: os.Stdout}
+	if err := s.RunFile(fs.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "[script failed: %s]\n", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "[script done]")
+	return 0
+}
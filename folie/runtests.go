@@ -0,0 +1,88 @@
+package main
+
+// The "test" subcommand, which runs forth unit tests on the attached microcontroller.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/tve/folie"
+)
+
+// runTests parses the test subcommand's flags, sends the test files to the microcontroller, and
+// reports the results. It returns the exit code: 0 if all tests passed, 1 if any failed, and 2
+// if the tests could not be run.
+func runTests(micro folie.MicroConn, args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: folie -p <port> test [flags] <files...>")
+		fs.PrintDefaults()
+	}
+	var (
+		junit   = fs.String("junit", "", "write JUnit XML to this file, instead of TAP to stdout")
+		start   = fs.String("start", folie.DefaultTestStart, "regexp matching test source lines")
+		fail    = fs.String("fail", folie.DefaultTestFail, "regexp matching failed test output")
+		timeout = fs.Duration("timeout", 3*time.Second, "maximum time to wait for each test")
+		reset   = fs.Bool("reset", false, "reset the microcontroller before each file")
+		verbose = fs.Bool("v", false, "show all output of the microcontroller on stderr")
+	)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	tr := &folie.TestRunner{Tx: micro, Timeout: *timeout, Reset: *reset}
+	var err error
+	if tr.Start, err = regexp.Compile(*start); err != nil {
+		fmt.Fprintf(os.Stderr, "-start: %s\n", err)
+		return 2
+	}
+	if tr.Fail, err = regexp.Compile(*fail); err != nil {
+		fmt.Fprintf(os.Stderr, "-fail: %s\n", err)
+		return 2
+	}
+	if *verbose {
+		tr.Log = os.Stderr
+	}
+
+	microInput := make(chan []byte, 1)
+	if err := folie.MicroConnRunner(micro, microInput, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	tr.Rx = microInput
+
+	passed := tr.Run(fs.Args())
+
+	if *junit != "" {
+		f, err := os.Create(*junit)
+		if err == nil {
+			err = tr.WriteJUnit(f)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		tr.WriteTAP(os.Stdout)
+	}
+
+	failed := 0
+	for _, r := range tr.Results {
+		if !r.Passed {
+			failed++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "[%d tests, %d failed]\n", len(tr.Results), failed)
+	if !passed {
+		return 1
+	}
+	return 0
+}
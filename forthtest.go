@@ -0,0 +1,173 @@
+package folie
+
+// This file contains the runner for "T{ ... -> ... }T" style forth unit tests.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Default patterns used by the TestRunner, they match the output of the classic tester.fs.
+const (
+	DefaultTestStart = `T\{`
+	DefaultTestFail  = `INCORRECT RESULT|WRONG NUMBER OF RESULTS`
+)
+
+// TestRunner sends forth test files to the target using the include machinery and determines
+// for each test line whether it passed, based on the target's reply. Every source line matching
+// Start counts as a test, it passes if the target processes it in time and the reply doesn't
+// match Fail. Other lines which fail, for example due to an unknown word, are reported as well.
+type TestRunner struct {
+	Tx      MicroConn     // send to microcontroller
+	Rx      <-chan []byte // receive from microcontroller
+	Start   *regexp.Regexp
+	Fail    *regexp.Regexp
+	Timeout time.Duration // per-line timeout, see matcher
+	Reset   bool          // reset the microcontroller before each file
+	Log     io.Writer     // gets all output of the target, may be nil
+
+	Results []TestResult
+}
+
+// TestResult is the outcome of one test.
+type TestResult struct {
+	File    string
+	Line    int
+	Source  string
+	Output  string
+	Passed  bool
+	Elapsed time.Duration
+}
+
+// Name returns a short description of the test.
+func (r *TestResult) Name() string {
+	return fmt.Sprintf("%s:%d %s", path.Base(r.File), r.Line, strings.TrimSpace(r.Source))
+}
+
+// Run sends all the files and collects the results. It returns true if all tests passed.
+func (tr *TestRunner) Run(files []string) bool {
+	if tr.Start == nil {
+		tr.Start = regexp.MustCompile(DefaultTestStart)
+	}
+	if tr.Fail == nil {
+		tr.Fail = regexp.MustCompile(DefaultTestFail)
+	}
+	log := tr.Log
+	if log == nil {
+		log = ioutil.Discard
+	}
+
+	for _, file := range files {
+		if tr.Reset {
+			tr.Tx.Reset(false)
+			tr.drain(log, 500*time.Millisecond)
+		}
+
+		start := time.Now()
+		in := &Includer{Tx: tr.Tx, Rx: tr.Rx, Stdout: log, Timeout: tr.Timeout}
+		in.OnReply = func(file string, lineNo int, line, reply string, ok bool) {
+			isTest := tr.Start.MatchString(line)
+			passed := ok && !tr.Fail.MatchString(reply)
+			if isTest || !ok {
+				tr.Results = append(tr.Results, TestResult{File: file, Line: lineNo,
+					Source: line, Output: reply, Passed: passed,
+					Elapsed: time.Since(start)})
+			}
+			start = time.Now()
+		}
+		n := len(tr.Results)
+		if !in.Include(file) && (len(tr.Results) == n || tr.Results[len(tr.Results)-1].Passed) {
+			// Make sure there is a failure to report, e.g. if a file could not be read.
+			tr.Results = append(tr.Results, TestResult{File: file, Source: "send aborted"})
+		}
+	}
+
+	allPassed := true
+	for _, r := range tr.Results {
+		allPassed = allPassed && r.Passed
+	}
+	return allPassed
+}
+
+// drain passes output from the target to log until it has been quiet for the specified time.
+func (tr *TestRunner) drain(log io.Writer, quiet time.Duration) {
+	for {
+		select {
+		case buf := <-tr.Rx:
+			log.Write(buf)
+			putBuffer(buf)
+		case <-time.After(quiet):
+			return
+		}
+	}
+}
+
+// WriteTAP writes the results in "Test Anything Protocol" format.
+func (tr *TestRunner) WriteTAP(w io.Writer) {
+	fmt.Fprintln(w, "TAP version 13")
+	fmt.Fprintf(w, "1..%d\n", len(tr.Results))
+	for i, r := range tr.Results {
+		status := "ok"
+		if !r.Passed {
+			status = "not ok"
+		}
+		fmt.Fprintf(w, "%s %d - %s\n", status, i+1, r.Name())
+		if !r.Passed {
+			for _, line := range strings.Split(strings.TrimRight(r.Output, "\r\n"), "\n") {
+				fmt.Fprintf(w, "# %s\n", strings.TrimRight(line, "\r"))
+			}
+		}
+	}
+}
+
+// junitSuite and junitCase define the subset of the JUnit XML format needed for the results.
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+// WriteJUnit writes the results as JUnit XML, as understood by most CI systems.
+func (tr *TestRunner) WriteJUnit(w io.Writer) error {
+	suite := junitSuite{Name: "folie", Tests: len(tr.Results)}
+	for _, r := range tr.Results {
+		c := junitCase{Name: r.Name(), ClassName: path.Base(r.File),
+			Time: r.Elapsed.Seconds()}
+		if !r.Passed {
+			suite.Failures++
+			c.Failure = &junitFailure{Message: "test failed", Output: r.Output}
+		}
+		suite.Time += c.Time
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,169 @@
+package folie
+
+// This file contains the hooks, which the switchboard runs when something happens to the
+// microcontroller, such as a reset.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Hooks lists what to do on each kind of event. Each line is either a ! command, such as
+// "!send init.fs", or forth source, which is sent using the include machinery, so it's paced by
+// the replies and can have include lines. Hooks should not reset the microcontroller themselves.
+type Hooks struct {
+	Connect []string // after connecting to the microcontroller, including after reconnecting
+	Reset   []string // after a reset, see Banner
+	Upload  []string // after successfully uploading firmware, this comes after the reset hook
+
+	// Banner, if set, is matched against the output of the microcontroller to detect resets,
+	// including the ones folie didn't cause itself, e.g. a watchdog. Without it, the reset
+	// hook runs when folie resets the microcontroller, once its output has quieted down.
+	Banner *regexp.Regexp
+}
+
+// bannerWindow is how much recent output is kept to match the banner against, so it's found even
+// when it arrives in several pieces.
+const bannerWindow = 256
+
+// hookSrc identifies hooks as source of input.
+const hookSrc = "hook"
+
+// afterReset arranges for the reset hook to run, unless resets are detected using the banner.
+func (sw *Switchboard) afterReset() {
+	if sw.Hooks.Banner == nil && !sw.inHook {
+		sw.queueHook("reset", sw.Hooks.Reset)
+	}
+}
+
+// pendingHook is a hook waiting to be run.
+type pendingHook struct {
+	event string
+	lines []string
+}
+
+// queueHook arranges for a hook to run once the switchboard is done with the current operation.
+// Hooks run in the order in which they were queued. It can be called from any goroutine.
+func (sw *Switchboard) queueHook(event string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	sw.mu.Lock()
+	sw.hooks = append(sw.hooks, pendingHook{event, lines})
+	sw.mu.Unlock()
+	go func() { sw.jobs <- sw.runHooks }()
+}
+
+// runHooks runs all the queued hooks.
+func (sw *Switchboard) runHooks() {
+	for {
+		sw.mu.Lock()
+		if len(sw.hooks) == 0 {
+			sw.mu.Unlock()
+			return
+		}
+		h := sw.hooks[0]
+		sw.hooks = sw.hooks[1:]
+		sw.mu.Unlock()
+
+		sw.runHook(h.event, h.lines)
+	}
+}
+
+// Reconfigure replaces the hooks and the macros, e.g. after the config file has been edited. It
+// can be called from any goroutine, the switchboard switches over once it's done with what it's
+// doing.
+func (sw *Switchboard) Reconfigure(hooks Hooks, macros map[string][]string) {
+	go func() {
+		sw.jobs <- func() {
+			sw.mu.Lock()
+			sw.Hooks = hooks
+			sw.mu.Unlock()
+			sw.Macros = macros
+		}
+	}()
+}
+
+// currentHooks returns the hooks, for use outside Run, where Reconfigure may change them.
+func (sw *Switchboard) currentHooks() Hooks {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return sw.Hooks
+}
+
+// watchBanner looks for the banner in data from the microcontroller, with recent the output seen
+// so far, and returns what to keep for next time. It runs in the tapMicroInput goroutine.
+func (sw *Switchboard) watchBanner(recent, data []byte) []byte {
+	hooks := sw.currentHooks()
+	if hooks.Banner == nil || len(hooks.Reset) == 0 {
+		return nil
+	}
+	recent = append(recent, data...)
+	if loc := hooks.Banner.FindIndex(recent); loc != nil {
+		sw.queueHook("reset", hooks.Reset)
+		recent = recent[loc[1]:]
+	}
+	if len(recent) > bannerWindow {
+		recent = recent[len(recent)-bannerWindow:]
+	}
+	return append([]byte(nil), recent...)
+}
+
+// runHook runs the lines of a hook, stopping at the first failure. It runs in the switchboard's
+// goroutine. Nobody else gets to send anything in the meantime, but if a client holds the lock
+// the hook is skipped, since it would interfere.
+func (sw *Switchboard) runHook(event string, lines []string) {
+	if owner := sw.owner(); owner != "" {
+		notify(nil, "%s hook skipped: locked by %s", event, owner)
+		return
+	}
+	defer sw.hold(hookSrc, event+" hook")()
+	sw.inHook = true
+	defer func() { sw.inHook = false }()
+
+	sw.tap(Event, hookSrc, []byte(event))
+	if event == "reset" && sw.Hooks.Banner == nil {
+		sw.drainMicro(500 * time.Millisecond) // let the banner pass by
+	}
+	sw.runLines(event+" hook", lines, &cmdClient{Src: hookSrc, Out: &consoleWriter{sw}, Role: RoleAdmin})
+}
+
+// runLines runs lines of ! commands and forth source on behalf of c, as hooks and macros do,
+// stopping at the first failure. Consecutive lines of forth source are sent together using the
+// include machinery, so they're paced by the replies. Name describes the lines in messages.
+func (sw *Switchboard) runLines(name string, lines []string, c *cmdClient) bool {
+	var forth []string
+	flush := func() bool {
+		if len(forth) == 0 {
+			return true
+		}
+		text := strings.Join(forth, "\n") + "\n"
+		forth = nil
+		in := &Includer{Tx: sw.to(c.Src), Rx: sw.MicroInput, Stdout: c.Out}
+		return sw.includeFunc(in, c.Src, func() bool {
+			return in.IncludeText(name, text)
+		})
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "!") {
+			forth = append(forth, line)
+			continue
+		}
+		if !flush() {
+			fmt.Fprintf(c.Out, "[%s failed]\n", name)
+			return false
+		}
+		if !sw.specialCommand(line, c) {
+			fmt.Fprintf(c.Out, "[%s: unknown command %s]\n", name, line)
+			return false
+		}
+	}
+	if !flush() {
+		fmt.Fprintf(c.Out, "[%s failed]\n", name)
+		return false
+	}
+	return true
+}
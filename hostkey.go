@@ -0,0 +1,68 @@
+package folie
+
+// This file contains the generation and persistence of the SSH server's host key.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyName is the name of the generated host key in the state directory.
+const hostKeyName = "ssh_host_ed25519_key"
+
+// StateDir returns the directory where folie keeps state between runs, i.e. $XDG_STATE_HOME/folie
+// or ~/.local/state/folie. The directory is not created.
+func StateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "folie")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".local", "state", "folie")
+}
+
+// loadHostKey reads and parses the host key in file.
+func loadHostKey(file string) (ssh.Signer, error) {
+	privateBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load host key from %s: %s", file, err)
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key from %s: %s", file, err)
+	}
+	return private, nil
+}
+
+// defaultHostKey returns folie's own host key from the state directory, generating a new
+// Ed25519 key the first time around.
+func defaultHostKey() (ssh.Signer, error) {
+	file := filepath.Join(StateDir(), hostKeyName)
+	if _, err := os.Stat(file); err == nil {
+		return loadHostKey(file)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate host key: %s", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "folie host key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode host key: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, fmt.Errorf("failed to save host key: %s", err)
+	}
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save host key: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "[ssh: generated new host key %s]\n", file)
+
+	return ssh.NewSignerFromKey(key)
+}
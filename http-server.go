@@ -0,0 +1,277 @@
+package folie
+
+// This file contains the HTTP server, which offers a REST API to control the microcontroller.
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxBodySize = 16 << 20    // limit on the size of uploaded firmware and source code
+	maxWait     = time.Minute // limit on the wait parameter
+)
+
+// HTTPServer offers a REST API, mainly meant for scripts and CI jobs which have no SSH keys. The
+// requests are mapped to NetInput in the same way as for the SSH server:
+//
+//	POST /reset    reset the microcontroller
+//	POST /flash    upload the firmware in the body (bin, hex, or elf format)
+//	POST /forth    send the forth source code in the body
+//	POST /packet   send the body as a packet
+//	GET  /status   report on the state of the switchboard
+//
+// POST requests can add "?wait=<duration>" to keep collecting output after the request has been
+// processed, for example to capture the banner after a reset. All requests can add "?board=<name>"
+// to select a board other than the first one. Responses are in JSON format. Include lines in POST
+// /forth can only refer to files inside the Files directory.
+type HTTPServer struct {
+	Token string // if not empty, clients must send an "Authorization: Bearer <token>" header
+	Files string // directory with the files of include lines in POST /forth, "" for none
+
+	listener net.Listener
+	boards   Boards
+}
+
+// httpResult is the response to a POST request.
+type httpResult struct {
+	OK     bool     `json:"ok"`
+	Error  string   `json:"error,omitempty"`
+	Output string   `json:"output"`          // everything shown on the console meanwhile
+	Files  []string `json:"files,omitempty"` // for /forth, the files pulled in by include lines
+	Lines  int      `json:"lines,omitempty"` // for /forth, the number of lines sent
+}
+
+// httpStatus is the response to GET /status.
+type httpStatus struct {
+	Board    string `json:"board"`
+	Port     string `json:"port"`
+	Conn     string `json:"connection"` // state of the connection to the board
+	LockedBy string `json:"locked_by"`  // client holding the exclusive lock, if any
+	Consoles int    `json:"consoles"`   // number of consoles receiving output
+}
+
+// NewHTTPServer creates a new HTTPServer and opens the listening socket. Clients must send the
+// token, if there is none they only get the operate role, and only clients on the same machine
+// can connect, unless token is "insecure", which lets anyone connect.
+func NewHTTPServer(listenAddr, token string) (*HTTPServer, error) {
+	if token == "insecure" {
+		token = ""
+	} else if token == "" && !isLoopback(listenAddr) {
+		return nil, fmt.Errorf("on %s requires a token, or \"insecure\" to let anyone connect",
+			listenAddr)
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %s", listenAddr, err)
+	}
+	return &HTTPServer{Token: token, listener: listener}, nil
+}
+
+// isLoopback returns true if addr only accepts connections from the same machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// role returns what clients are permitted to do: without a token anyone who can connect gets
+// in, so they can't upload forth source nor flash firmware.
+func (hs *HTTPServer) role() Role {
+	if hs.Token == "" {
+		return RoleOperate
+	}
+	return RoleAdmin
+}
+
+// Run serves requests, pushing them into the network input of the selected board. The board's
+// switchboard is used to collect the output produced while processing each request.
+func (hs *HTTPServer) Run(boards Boards) {
+	hs.boards = boards
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reset", hs.handler(ResetIn))
+	mux.HandleFunc("/flash", hs.handler(FlashIn))
+	mux.HandleFunc("/forth", hs.handler(ForthIn))
+	mux.HandleFunc("/packet", hs.handler(PacketIn))
+	mux.HandleFunc("/status", hs.status)
+
+	err := http.Serve(hs.listener, hs.authorize(mux))
+	fmt.Fprintf(os.Stderr, "fatal HTTP server error: %s\n", err)
+}
+
+// board returns the board selected by the request, or nil if there is no such board, in which case
+// an error has been sent.
+func (hs *HTTPServer) board(w http.ResponseWriter, r *http.Request) *Board {
+	name := r.URL.Query().Get("board")
+	if name == "" {
+		return hs.boards[0]
+	}
+	b := hs.boards.Find(name)
+	if b == nil {
+		http.Error(w, "no such board: "+name, http.StatusNotFound)
+	}
+	return b
+}
+
+// authorize checks the token, if one is required.
+func (hs *HTTPServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "Bearer " + hs.Token
+		got := r.Header.Get("Authorization")
+		if hs.Token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handler returns the handler for POST requests of the specified kind.
+func (hs *HTTPServer) handler(what int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		b := hs.board(w, r)
+		if b == nil {
+			return
+		}
+		var wait time.Duration
+		if s := r.URL.Query().Get("wait"); s != "" {
+			var err error
+			if wait, err = time.ParseDuration(s); err != nil || wait < 0 || wait > maxWait {
+				if err == nil {
+					err = fmt.Errorf("must be between 0 and %s", maxWait)
+				}
+				http.Error(w, "invalid wait: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if _, ok := err.(*http.MaxBytesError); ok {
+			// Don't send out a truncated firmware image or source code.
+			http.Error(w, fmt.Sprintf("body larger than %d MB", maxBodySize>>20),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var res httpResult
+		if what == ForthIn {
+			if body, err = hs.expand(body, &res); err != nil {
+				res.Error = err.Error()
+				writeJSON(w, http.StatusBadRequest, res)
+				return
+			}
+		}
+
+		// Collect the console output and any notices while the request is processed.
+		out := &syncBuffer{}
+		b.SW.AddConsoleOutput(out)
+		done := make(chan struct{})
+		from := "http:" + r.RemoteAddr
+		b.Input <- NetInput{What: what, Buf: body, From: from, Reply: out, Done: done, Err: &err,
+			Role: hs.role()}
+		<-done
+		time.Sleep(wait)
+		b.SW.RemoveConsoleOutput(out)
+
+		res.OK = err == nil
+		if err != nil {
+			res.Error = err.Error()
+		}
+		res.Output = out.String()
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// expand expands the include lines in forth source code, using the files directory, and records
+// which files were included and how many lines will be sent.
+func (hs *HTTPServer) expand(src []byte, res *httpResult) ([]byte, error) {
+	if hs.Files == "" || !bytes.Contains(src, []byte("include ")) {
+		res.Lines = bytes.Count(src, []byte{'\n'})
+		return src, nil
+	}
+
+	// The Includer works on files, so put the source in one next to those it includes.
+	f, err := ioutil.TempFile(hs.Files, ".http-*.fs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(src)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var code bytes.Buffer
+	in := &Includer{Tx: &code, DryRun: true, Root: hs.Files}
+	if !in.Include(f.Name()) {
+		return nil, fmt.Errorf("expanding includes failed")
+	}
+	res.Files = in.Files[1:]
+	res.Lines = in.Lines
+	return code.Bytes(), nil
+}
+
+// status handles GET /status.
+func (hs *HTTPServer) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	b := hs.board(w, r)
+	if b == nil {
+		return
+	}
+	b.SW.mu.Lock()
+	st := httpStatus{Board: b.Name, Port: b.Port, Conn: b.SW.connState.String(),
+		LockedBy: b.SW.lockedBy, Consoles: len(b.SW.consoleOutput)}
+	b.SW.mu.Unlock()
+	writeJSON(w, http.StatusOK, st)
+}
+
+// writeJSON sends a JSON response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// syncBuffer is a bytes.Buffer which can be written from multiple goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
@@ -4,178 +4,371 @@ package folie
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/chzyer/readline"
 )
 
-var callCount int
+// Includer sends forth source files to the target line by line, expanding embedded include
+// directives as needed. In a dry run nothing is matched against replies, the expanded source is
+// simply written to Tx, optionally with "\ file:line" markers showing where each line came from.
+type Includer struct {
+	Tx     io.Writer     // where to send the source lines
+	Rx     <-chan []byte // replies from the target, not used in a dry run
+	DryRun bool          // only write the expanded source to Tx
+	Origin bool          // in a dry run, precede each line by a "\ file:line" marker
+	Root   string        // if set, included files must be inside this directory, see rootedPath
+
+	Stdout  io.Writer     // where to show replies, defaults to os.Stdout
+	Timeout time.Duration // how long to wait for a reply to each line, see match
+	// OnReply, if set, is called with each line sent, where it came from, everything received
+	// in reply, and whether the target processed the line in time and without errors.
+	OnReply func(file string, lineNo int, line, reply string, ok bool)
+
+	Files   []string      // all files read by the last Include, in order
+	Lines   int           // number of lines sent by the last Include
+	Bytes   int           // number of bytes sent by the last Include
+	Elapsed time.Duration // how long the last Include took
+
+	callCount int
+	matcher   *matcher
+	joined    sourceLine // stripped lines waiting to be sent as one, see JoinWidth
+	inFlight  []sentLine // lines sent but not yet processed, see LinesInFlight
+}
+
+// sentLine is a line which has been sent to the target but for which the reply is outstanding.
+type sentLine struct {
+	sourceLine
+	sent time.Time
+}
+
+// sourceLine is one line of expanded source plus where it came from.
+type sourceLine struct {
+	text string
+	file string
+	line int
+}
+
+// Include sends out one file and everything it includes. It returns false if a file cannot be
+// read or if the target reports an error.
+func (in *Includer) Include(name string) bool {
+	return in.run(func() bool { return in.includeFile(name, 0) })
+}
+
+// IncludeText sends out forth source text and everything it includes, as if it was a file with
+// the specified name. Included files are looked up relative to the current directory.
+func (in *Includer) IncludeText(name, text string) bool {
+	return in.run(func() bool { return in.includeReader(strings.NewReader(text), name, 0) })
+}
+
+// run sends out the source produced by send and waits for the remaining replies.
+func (in *Includer) run(send func() bool) bool {
+	in.callCount = 0
+	in.joined = sourceLine{}
+	in.Files = nil
+	in.Lines = 0
+	in.Bytes = 0
+	start := time.Now()
+	defer func() { in.Elapsed = time.Since(start) }()
+
+	ok := send() && in.flush()
+	// Wait for the remaining replies, even after a failure, since those lines have been sent.
+	for len(in.inFlight) > 0 {
+		ok = in.complete() && ok
+	}
+	return ok
+}
+
+// Stats returns a summary of the amount of data sent by the last Include and how fast it went.
+func (in *Includer) Stats() string {
+	secs := in.Elapsed.Seconds()
+	if secs <= 0 {
+		return fmt.Sprintf("%d lines, %d bytes", in.Lines, in.Bytes)
+	}
+	return fmt.Sprintf("%d lines, %d bytes in %.1fs: %.0f lines/s, %.0f bytes/s",
+		in.Lines, in.Bytes, secs, float64(in.Lines)/secs, float64(in.Bytes)/secs)
+}
 
 // includeFile sends out one file onto tx, line by line, expanding embedded includes as needed.
-func includeFile(tx io.Writer, rx <-chan []byte, name string, level int) bool {
+func (in *Includer) includeFile(name string, level int) bool {
 	f, err := os.Open(name)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot open %s: %s\n", name, err)
 		return false
 	}
 	defer f.Close()
+	in.Files = append(in.Files, name)
+	return in.includeReader(f, name, level)
+}
 
+// includeReader sends out the source read from r, which came from the named file.
+func (in *Includer) includeReader(r io.Reader, name string, level int) bool {
 	currDir := path.Dir(name)
 	currFile := path.Base(name)
 	currLine := 0
-	if level == 0 {
-		callCount = 0
-	}
-	callCount++
-	prefix := fmt.Sprintf("%d>", callCount)
+	in.callCount++
+	prefix := fmt.Sprintf("%d>", in.callCount)
 
 	lastMsg := ""
 	defer func() {
-		statusMsg(lastMsg, "")
+		in.status(lastMsg, "")
 	}()
 
-	scanner := bufio.NewScanner(f)
+	strip := StripSource
+
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		currLine++
-		lastMsg = statusMsg(lastMsg, "%s %s %d: ", prefix, currFile, currLine)
+		lastMsg = in.status(lastMsg, "%s %s %d: ", prefix, currFile, currLine)
 
 		line := scanner.Text()
+		if strings.HasPrefix(line, directivePrefix) {
+			for _, d := range strings.Fields(line[len(directivePrefix):]) {
+				if d == "nostrip" {
+					strip = false
+				}
+			}
+		}
 		s := strings.TrimLeft(line, " ")
 		if s == "" || s == "\\" || strings.HasPrefix(s, "\\ ") {
 			continue // don't send empty or comment-only lines
 		}
 
 		if strings.HasPrefix(line, "include ") {
+			if !in.flush() {
+				return false
+			}
 			for _, fname := range strings.Fields(line)[1:] {
-				statusMsg(lastMsg, "")
-				if !includeFile(tx, rx, path.Join(currDir, fname), level+1) {
+				in.status(lastMsg, "")
+				file := findInclude(currDir, fname)
+				if in.Root != "" {
+					var err error
+					if file, err = rootedPath(in.Root, currDir, fname); err != nil {
+						fmt.Fprintf(os.Stderr, "Cannot include %s: %s\n", fname, err)
+						return false
+					}
+				}
+				if !in.includeFile(file, level+1) {
 					return false
 				}
 			}
-		} else {
-			buf := make([]byte, len(line)+1)
-			copy(buf, line)
-			buf[len(line)] = '\r'
+			continue
+		}
 
-			tx.Write(buf)
-			if !match(line, rx) {
-				return false
+		src := sourceLine{line, name, currLine}
+		if strip {
+			if src.text = minifyLine(line); src.text == "" {
+				continue
 			}
+			if JoinWidth > 0 {
+				if in.joined.text == "" {
+					in.joined = src
+					continue
+				}
+				if len(in.joined.text)+1+len(src.text) <= JoinWidth {
+					in.joined.text += " " + src.text
+					continue
+				}
+				src, in.joined = in.joined, src
+			}
+		} else if !in.flush() { // joined lines go first, to keep the source in order
+			return false
+		}
+		if !in.send(src) {
+			return false
 		}
 	}
 
 	return true
 }
 
-// statusMsg prints a formatted string and returns it. It takes the previous
-// string to be able to clear it before outputting the new message.
-func statusMsg(prev string, desc string, args ...interface{}) string {
-	msg := fmt.Sprintf(desc, args...)
-	n := len(msg)
-	// FIXME this optimisation is incorrect, it sometimes eats up first 3 chars
-	if false && n > 3 && n == len(prev) && msg[:n-3] == prev[:n-3] {
-		fmt.Print("\b\b\b", msg[n-3:]) // optimise if only end changes
-	} else {
-		if len(msg) < len(prev) {
-			fmt.Print("\r", strings.Repeat(" ", len(prev)))
+// IncludePath lists extra directories to search for included files which are not found relative
+// to the file including them, for example a shared library of drivers.
+var IncludePath []string
+
+// findInclude returns the path of an included file. It's looked up relative to the directory of
+// the including file first, then in each of the IncludePath directories. If it can't be found,
+// the path relative to the including file is returned, for the error message.
+func findInclude(dir, name string) string {
+	local := path.Join(dir, name)
+	if fileExists(local) || path.IsAbs(name) {
+		return local
+	}
+	for _, d := range IncludePath {
+		if p := path.Join(d, name); fileExists(p) {
+			return p
 		}
-		fmt.Print("\r", msg)
 	}
-	return msg
+	return local
 }
 
-func match(expect string, rx <-chan []byte) bool {
-	timer := time.NewTimer(3 * time.Second)
+// rootedPath returns the path of a file named relative to dir, which must be inside root, e.g.
+// for files received from the network. Names which are absolute or contain ".." are rejected, as
+// are symbolic links leading out of root. For files which don't exist yet, e.g. to be written, the
+// nearest existing directory above them is checked. The IncludePath is not searched.
+func rootedPath(root, dir, name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("absolute paths are not allowed")
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("\"..\" is not allowed")
+		}
+	}
+	p := filepath.Join(dir, name)
+	if !within(root, p) {
+		return "", fmt.Errorf("outside of %s", root)
+	}
+	for dir := p; within(root, dir); dir = filepath.Dir(dir) {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if realRoot, err := filepath.EvalSymlinks(root); err != nil || !within(realRoot, real) {
+				return "", fmt.Errorf("links outside of %s", root)
+			}
+			break
+		}
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("links to a missing file") // it could be created anywhere
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return p, nil
+}
 
-	var pending []byte
-	for {
-		select {
+// within returns true if p is inside the dir directory.
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
-		case data := <-rx:
-			pending = append(pending, data...)
-			if !timer.Stop() {
-				<-timer.C
-			}
-			timer.Reset(time.Second)
+// fileExists returns true if name is an existing file.
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
 
-		/*	case <-commandSend:
-			return false // abort include
-		*/
+// ExpandFile performs a dry run of sending a file: the fully expanded source is written to the
+// out file, or to stdout if out is empty. With origin set each line is preceded by a marker
+// comment showing the file and line it came from.
+func ExpandFile(name, out string, origin bool) error {
+	w := io.Writer(os.Stdout)
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return expand(name, w, origin)
+}
 
-		case <-time.After(10 * time.Millisecond):
-			if !bytes.Contains(pending, []byte{'\n'}) {
-				continue
-			}
+// expand writes the expanded source of a file to w.
+func expand(name string, w io.Writer, origin bool) error {
+	in := &Includer{Tx: w, DryRun: true, Origin: origin}
+	if !in.Include(name) {
+		return fmt.Errorf("expanding %s failed", name)
+	}
+	return nil
+}
 
-			lines := bytes.Split(pending, []byte{'\n'})
-			// Print and then discard all but the last complete line and the possible
-			// start of an incomplete line.
-			n := len(lines)
-			for i := 0; i < n-2; i++ {
-				fmt.Printf("%s\n", lines[i])
-			}
-			lines = lines[n-2:]
-
-			last := string(lines[0]) // line[0] is the last complete line
-			if len(lines[1]) == 0 {
-				// There is no partial line, so mecrisp may have caught up.
-				hasExpected := strings.HasPrefix(last, expect+" ")
-				if hasExpected || strings.HasSuffix(last, " ok.") {
-					if last != expect+"  ok." {
-						msg := last
-						// only show output if source does not start with "("
-						// ... in that case, show just the comment up to ")"
-						if hasExpected {
-							msg = last[len(expect)+1:]
-							if last[0] == '(' {
-								if n := strings.Index(expect, ")"); n > 0 {
-									msg = last[:n+1] + last[len(expect):]
-								}
-							}
-						}
-						if msg == "" {
-							return true // don't show empty [if]-skipped lines
-						}
-						fmt.Printf("%s\n", msg)
-						if hasFatalError(last) {
-							return false // no point in keeping going
-						}
-					}
-					return true
-				}
-			}
-			fmt.Printf("%s\n", last)
-			pending = lines[1]
+// directivePrefix starts a comment line with folie-specific settings for the current file, the
+// only one so far is "nostrip" to send the file as-is even if StripSource is set.
+const directivePrefix = "\\ folie:"
 
-		case <-timer.C:
-			if len(pending) == 0 {
-				return true
-			}
-			fmt.Printf("%s (timeout)\n", pending)
-			return string(pending) == expect+" "
+// flush sends any joined lines which are still pending.
+func (in *Includer) flush() bool {
+	if in.joined.text == "" {
+		return true
+	}
+	src := in.joined
+	in.joined = sourceLine{}
+	return in.send(src)
+}
+
+// send sends one line to the target. Once LinesInFlight lines are outstanding it waits for the
+// oldest one to be processed. In a dry run it writes the line out, preceded by its origin if
+// requested.
+func (in *Includer) send(src sourceLine) bool {
+	in.Lines++
+	if in.DryRun {
+		if in.Origin {
+			fmt.Fprintf(in.Tx, "\\ %s:%d\n", src.file, src.line)
 		}
+		_, err := fmt.Fprintf(in.Tx, "%s\n", src.text)
+		return err == nil
 	}
+
+	buf := make([]byte, len(src.text)+1)
+	copy(buf, src.text)
+	buf[len(src.text)] = '\r'
+
+	in.Tx.Write(buf)
+	in.Bytes += len(buf)
+	in.inFlight = append(in.inFlight, sentLine{src, time.Now()})
+
+	for len(in.inFlight) >= LinesInFlight || len(in.inFlight) > 0 && LinesInFlight < 1 {
+		if !in.complete() {
+			return false
+		}
+	}
+	return true
 }
 
-func hasFatalError(s string) bool {
-	for _, match := range []string{
-		" not found.",
-		" is compile-only.",
-		" Stack not balanced.",
-		" Stack underflow",
-		" Stack overflow",
-		" Flash full",
-		" Ram full",
-		" Structures don't match",
-		" Jump too far",
-	} {
-		if strings.HasSuffix(s, match) {
-			return true
+// complete waits for the reply to the oldest line in flight.
+func (in *Includer) complete() bool {
+	if in.matcher == nil {
+		in.matcher = &matcher{Rx: in.Rx, Out: in.Stdout, Timeout: in.Timeout}
+	}
+	sl := in.inFlight[0]
+	in.inFlight = in.inFlight[1:]
+
+	ok := in.matcher.match(sl.text, sl.sent)
+	if in.OnReply != nil {
+		in.OnReply(sl.file, sl.line, sl.text, string(in.matcher.Reply),
+			ok && !in.matcher.TimedOut)
+	}
+	return ok
+}
+
+// statusMsg prints a formatted string and returns it. It takes the previous
+// string to be able to clear it before outputting the new message.
+func statusMsg(w io.Writer, prev string, desc string, args ...interface{}) string {
+	msg := fmt.Sprintf(desc, args...)
+	n := len(msg)
+	// FIXME this optimisation is incorrect, it sometimes eats up first 3 chars
+	if false && n > 3 && n == len(prev) && msg[:n-3] == prev[:n-3] {
+		fmt.Fprint(w, "\b\b\b", msg[n-3:]) // optimise if only end changes
+	} else {
+		if len(msg) < len(prev) {
+			fmt.Fprint(w, "\r", strings.Repeat(" ", len(prev)))
 		}
+		fmt.Fprint(w, "\r", msg)
+	}
+	return msg
+}
+
+// status shows the progress of sending on Stdout using statusMsg. It's not shown in dry runs,
+// when the caller follows the replies using OnReply, nor when stdout is not a terminal, so it
+// doesn't end up in redirected output.
+func (in *Includer) status(prev string, desc string, args ...interface{}) string {
+	if in.DryRun || in.OnReply != nil {
+		return ""
+	}
+	w := in.Stdout
+	if w == nil {
+		w = os.Stdout
+	}
+	if w == os.Stdout && !readline.IsTerminal(1) {
+		return ""
 	}
-	return false
+	return statusMsg(w, prev, desc, args...)
 }
@@ -0,0 +1,70 @@
+package folie
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIncludeJoin(t *testing.T) {
+	defer func(strip bool, width int) { StripSource, JoinWidth = strip, width }(StripSource, JoinWidth)
+	StripSource = true
+
+	tests := []struct {
+		width int
+		src   string
+		want  string
+	}{
+		{0, "1  2\n( c ) 3\n", "1 2\n3\n"},
+		{12, "1 2\n3 4\n5 6 7\n8\n", "1 2 3 4\n5 6 7 8\n"},
+		{12, "\\ comment\n1\n\n2 \\ two\n", "1 2\n"},
+		{12, "1\n2\n\\ folie: nostrip\n3  \\ keep\n4\n", "1 2\n3  \\ keep\n4\n"},
+		{12, "1\n\\ folie: nostrip\n: x  ( n -- )\n", "1\n: x  ( n -- )\n"},
+	}
+	for _, tt := range tests {
+		JoinWidth = tt.width
+		var out bytes.Buffer
+		in := &Includer{Tx: &out, DryRun: true}
+		if !in.IncludeText("test.fs", tt.src) {
+			t.Errorf("including %q failed", tt.src)
+		}
+		if out.String() != tt.want {
+			t.Errorf("including %q with join %d = %q, want %q", tt.src, tt.width, out.String(),
+				tt.want)
+		}
+	}
+}
+
+func TestRootedPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(root, "lib"), 0755)
+	os.WriteFile(filepath.Join(root, "lib", "a.fs"), nil, 0644)
+	os.Symlink(outside, filepath.Join(root, "out"))
+	os.Symlink(filepath.Join(root, "lib"), filepath.Join(root, "in"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+
+	tests := []struct {
+		dir, name string
+		ok        bool
+	}{
+		{".", "lib/a.fs", true},
+		{".", ".", true},
+		{".", "new.fs", true},
+		{"lib", "a.fs", true},
+		{"lib", "new/b.fs", true},
+		{".", "in/a.fs", true},
+		{".", "/etc/passwd", false},
+		{"lib", "../lib/a.fs", false},
+		{".", "out/x.fs", false},
+		{".", "out", false},
+		{".", "dangling", false},
+	}
+	for _, tt := range tests {
+		_, err := rootedPath(root, filepath.Join(root, tt.dir), tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("rootedPath(%q, %q) error = %v, want ok %v", tt.dir, tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package folie
+
+// This file contains the key bindings of the console, which enter a line, such as a ! command,
+// when a function key is pressed.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyBindings maps function keys, "F1" to "F12", to the line entered by pressing them. The line
+// being edited is left as is. An empty line removes a binding.
+var KeyBindings = map[string]string{
+	"F5": "!send", // send the same file again
+	"F9": "!reset",
+}
+
+// functionKeys maps the escape sequences terminals send for the function keys to their number,
+// these are the ones of xterm and compatibles, and of rxvt for F1 to F4.
+var functionKeys = map[string]int{
+	"\x1bOP": 1, "\x1bOQ": 2, "\x1bOR": 3, "\x1bOS": 4,
+	"\x1b[11~": 1, "\x1b[12~": 2, "\x1b[13~": 3, "\x1b[14~": 4,
+	"\x1b[15~": 5, "\x1b[17~": 6, "\x1b[18~": 7, "\x1b[19~": 8,
+	"\x1b[20~": 9, "\x1b[21~": 10, "\x1b[23~": 11, "\x1b[24~": 12,
+}
+
+// keyRune returns the rune which stands for function key n inside readline, it's taken from a
+// Unicode private use area, so it can't be typed otherwise.
+func keyRune(n int) rune {
+	return 0xF700 + rune(n)
+}
+
+// keyLines receives the lines entered using key bindings, RunConsole passes them on.
+var keyLines = make(chan string, 4)
+
+// parseKey returns the number of a function key given by name, e.g. "F5".
+func parseKey(name string) (int, error) {
+	name = strings.ToUpper(name)
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "F"))
+	if err != nil || !strings.HasPrefix(name, "F") || n < 1 || n > 12 {
+		return 0, fmt.Errorf("unknown key %q, use F1 to F12", name)
+	}
+	return n, nil
+}
+
+// keyFilter returns a readline FuncFilterInputRune, which enters the lines of KeyBindings.
+func keyFilter() (func(rune) (rune, bool), error) {
+	bound := map[rune]string{}
+	for name, line := range KeyBindings {
+		n, err := parseKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if line != "" {
+			bound[keyRune(n)] = line
+		}
+	}
+	return func(r rune) (rune, bool) {
+		if r < keyRune(1) || r > keyRune(12) {
+			return r, true
+		}
+		if line, ok := bound[r]; ok {
+			select {
+			case keyLines <- line:
+			default: // don't hold up readline if the switchboard is busy
+			}
+		}
+		return r, false
+	}, nil
+}
+
+// showKeys lists the key bindings, for the help message.
+func showKeys(w io.Writer) {
+	var keys []string
+	for name, line := range KeyBindings {
+		if line != "" {
+			keys = append(keys, name)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := parseKey(keys[i])
+		b, _ := parseKey(keys[j])
+		return a < b
+	})
+	for i, name := range keys {
+		keys[i] = fmt.Sprintf("%s = %s", name, KeyBindings[name])
+	}
+	fmt.Fprintf(w, "Keys: %s\n", strings.Join(keys, ", "))
+}
+
+// keyReader translates the escape sequences of function keys into the runes of keyRune, since
+// readline ignores them.
+type keyReader struct {
+	r       io.Reader
+	pending []byte // translated input not yet read
+	partial []byte // received input which may be the start of an escape sequence
+}
+
+func (kr *keyReader) Read(p []byte) (int, error) {
+	for len(kr.pending) == 0 {
+		var buf [64]byte
+		n, err := kr.r.Read(buf[:])
+		kr.pending, kr.partial = translateKeys(append(kr.partial, buf[:n]...))
+		if err != nil {
+			// No more input can complete an escape sequence, pass on what's left as is.
+			kr.pending, kr.partial = append(kr.pending, kr.partial...), nil
+			if len(kr.pending) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	n := copy(p, kr.pending)
+	kr.pending = kr.pending[n:]
+	return n, nil
+}
+
+// translateKeys replaces the escape sequences of function keys in data by their runes. It
+// returns the result, and what's left over at the end that may be the start of an escape
+// sequence, to be translated once more data arrives.
+func translateKeys(data []byte) (out, partial []byte) {
+	for i := 0; i < len(data); i++ {
+		if data[i] == '\x1b' {
+			n, prefix := matchKey(data[i:])
+			if n > 0 {
+				out = append(out, string(keyRune(functionKeys[string(data[i:i+n])]))...)
+				i += n - 1
+				continue
+			}
+			if prefix {
+				return out, data[i:]
+			}
+		}
+		out = append(out, data[i])
+	}
+	return out, nil
+}
+
+// matchKey returns the length of the escape sequence of a function key at the start of data, or
+// 0 if there is none. Prefix tells whether data may be the start of such a sequence.
+func matchKey(data []byte) (n int, prefix bool) {
+	for seq := range functionKeys {
+		if bytes.HasPrefix(data, []byte(seq)) {
+			return len(seq), false
+		}
+		if strings.HasPrefix(seq, string(data)) {
+			prefix = true
+		}
+	}
+	return 0, prefix
+}
@@ -0,0 +1,96 @@
+package folie
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMatchKey(t *testing.T) {
+	tests := []struct {
+		data   string
+		n      int
+		prefix bool
+	}{
+		{"\x1b", 0, true},
+		{"\x1bO", 0, true},
+		{"\x1bOP", 3, false},
+		{"\x1bOPx", 3, false},
+		{"\x1b[1", 0, true},
+		{"\x1b[15", 0, true},
+		{"\x1b[15~", 5, false},
+		{"\x1b[24~rest", 5, false},
+		{"\x1b[A", 0, false}, // cursor up is left to readline
+		{"\x1b[16~", 0, false},
+		{"x", 0, false},
+	}
+	for _, tt := range tests {
+		n, prefix := matchKey([]byte(tt.data))
+		if n != tt.n || prefix != tt.prefix {
+			t.Errorf("matchKey(%q) = %d, %v, want %d, %v", tt.data, n, prefix, tt.n, tt.prefix)
+		}
+	}
+}
+
+func TestTranslateKeys(t *testing.T) {
+	f1, f5, f12 := string(keyRune(1)), string(keyRune(5)), string(keyRune(12))
+	tests := []struct {
+		data    string
+		out     string
+		partial string
+	}{
+		{"", "", ""},
+		{"abc", "abc", ""},
+		{"\x1bOP", f1, ""},
+		{"a\x1b[15~b\x1b[24~", "a" + f5 + "b" + f12, ""},
+		{"\x1b[A\x1b[11~", "\x1b[A" + f1, ""},
+		{"ab\x1b[1", "ab", "\x1b[1"},
+		{"\x1b", "", "\x1b"},
+		{"\x1b[1x", "\x1b[1x", ""},
+	}
+	for _, tt := range tests {
+		out, partial := translateKeys([]byte(tt.data))
+		if string(out) != tt.out || string(partial) != tt.partial {
+			t.Errorf("translateKeys(%q) = %q, %q, want %q, %q",
+				tt.data, out, partial, tt.out, tt.partial)
+		}
+	}
+}
+
+// chunkReader returns each of its chunks from a separate Read.
+type chunkReader struct {
+	chunks []string
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if len(cr.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, cr.chunks[0])
+	cr.chunks = cr.chunks[1:]
+	return n, nil
+}
+
+func TestKeyReader(t *testing.T) {
+	f5, f9 := string(keyRune(5)), string(keyRune(9))
+	tests := []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"ab", "c\r"}, "abc\r"},
+		{[]string{"\x1b[15~"}, f5},
+		{[]string{"x\x1b", "[20~y"}, "x" + f9 + "y"},
+		{[]string{"\x1b", "[", "1", "5", "~"}, f5},
+		{[]string{"\x1b[1", "x"}, "\x1b[1x"},
+		{[]string{"z\x1b[2"}, "z\x1b[2"}, // incomplete sequence at the end of the input
+	}
+	for _, tt := range tests {
+		var got bytes.Buffer
+		if _, err := io.Copy(&got, &keyReader{r: &chunkReader{chunks: tt.chunks}}); err != nil {
+			t.Errorf("reading %q failed: %s", tt.chunks, err)
+		}
+		if got.String() != tt.want {
+			t.Errorf("reading %q = %q, want %q", tt.chunks, got.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package folie
+
+// This file contains the arbitration between multiple clients sending input to the switchboard.
+
+import (
+	"fmt"
+	"io"
+)
+
+// ConsoleSrc identifies the local interactive console as source of input.
+const ConsoleSrc = "console"
+
+// Input from all clients is normally interleaved as it arrives. A client can take an exclusive
+// lock, which makes all other clients read-only until it releases the lock (or disconnects).
+// Long operations, such as uploads, implicitly hold the lock for their duration.
+
+// notify sends a notice to a single client, or to the local console if w is nil.
+func notify(w io.Writer, format string, args ...interface{}) {
+	msg := fmt.Sprintf("["+format+"]\n", args...)
+	if w == nil {
+		fmt.Print(msg)
+	} else {
+		io.WriteString(w, "\r\n"+msg[:len(msg)-1]+"\r\n")
+	}
+}
+
+// owner returns the client holding the lock, or an empty string if nobody does.
+func (sw *Switchboard) owner() string {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return sw.lockedBy
+}
+
+// allowed returns true if src may send to the microcontroller, i.e. if nobody else holds the
+// lock. If not, a notice is sent to reply.
+func (sw *Switchboard) allowed(src string, reply io.Writer) bool {
+	if owner := sw.owner(); owner != "" && owner != src {
+		notify(reply, "locked by %s, input ignored", owner)
+		return false
+	}
+	return true
+}
+
+// lock gives src the exclusive lock, unless someone else already holds it.
+func (sw *Switchboard) lock(src string, reply io.Writer) {
+	sw.mu.Lock()
+	owner := sw.lockedBy
+	if owner == "" {
+		sw.lockedBy = src
+	}
+	sw.mu.Unlock()
+
+	switch owner {
+	case "":
+		sw.consoleWrite([]byte(fmt.Sprintf("\n[locked by %s, others are read-only]\n", src)))
+	case src:
+		notify(reply, "you already hold the lock")
+	default:
+		notify(reply, "already locked by %s", owner)
+	}
+}
+
+// unlock releases the exclusive lock if src holds it.
+func (sw *Switchboard) unlock(src string, reply io.Writer) {
+	sw.mu.Lock()
+	released := sw.lockedBy == src
+	if released {
+		sw.lockedBy = ""
+	}
+	sw.mu.Unlock()
+
+	if released {
+		sw.consoleWrite([]byte(fmt.Sprintf("\n[unlocked by %s]\n", src)))
+	}
+}
+
+// hold marks the switchboard as busy with a long operation on behalf of src, such as an upload.
+// Until the returned release function is called, input from src is deferred and input from all
+// other clients is rejected with a notice. This keeps others from interfering with the operation
+// even though they have not been locked out explicitly. A reset from src is carried out right
+// away though, see interrupt, it's how a remote client presses ctrl-c to stop the operation.
+// Holds can be nested, e.g. a macro sending a file, only the outermost one defers input.
+func (sw *Switchboard) hold(src, what string) (release func()) {
+	sw.holds++
+	if sw.holds > 1 {
+		return func() { sw.holds-- }
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var consoleLater [][]byte
+	var networkLater []NetInput
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case buf := <-sw.ConsoleInput:
+				if src == ConsoleSrc {
+					consoleLater = append(consoleLater, buf)
+				} else {
+					notify(nil, "busy with %s for %s, input ignored", what, src)
+				}
+			case inp := <-sw.NetworkInput:
+				switch {
+				case inp.From == src && inp.What == ResetIn:
+					sw.interrupt(inp)
+				case inp.From == src, inp.What == UnlockIn: // don't lose track of disconnects
+					networkLater = append(networkLater, inp)
+				default:
+					notify(inp.Reply, "busy with %s for %s, input ignored", what, src)
+					if inp.Err != nil {
+						*inp.Err = fmt.Errorf("busy with %s for %s", what, src)
+					}
+					if inp.Done != nil {
+						close(inp.Done)
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		sw.holds--
+		for _, buf := range consoleLater {
+			sw.consoleInput(buf)
+		}
+		for _, inp := range networkLater {
+			sw.networkInput(inp)
+		}
+	}
+}
+
+// interrupt resets the microcontroller on behalf of the client holding the switchboard, while the
+// operation it started is still running. Since that runs in Run, interrupt only uses what's safe
+// from another goroutine: the taps, the connection, currentHooks, and queueHook.
+func (sw *Switchboard) interrupt(inp NetInput) {
+	var err error
+	if need := requiredRole(ResetIn); inp.Role < need {
+		err = fmt.Errorf("permission denied, %s role required", need)
+	} else {
+		sw.tap(Event, inp.From, []byte("reset"))
+		if !sw.MicroOutput.Reset(false) {
+			err = fmt.Errorf("reset failed")
+		} else if hooks := sw.currentHooks(); hooks.Banner == nil {
+			sw.queueHook("reset", hooks.Reset)
+		}
+	}
+	if err != nil {
+		notify(inp.Reply, "%s", err)
+	}
+	if inp.Err != nil {
+		*inp.Err = err
+	}
+	if inp.Done != nil {
+		close(inp.Done)
+	}
+}
+
+// wrappedLock implements the !lock and !unlock commands.
+func (sw *Switchboard) wrappedLock(argv []string, c *cmdClient) {
+	if argv[0] == "!lock" {
+		sw.lock(c.Src, c.reply())
+	} else if owner := sw.owner(); owner != c.Src {
+		fmt.Fprintf(c.Out, "Not locked by %s.\n", c.Src)
+	} else {
+		sw.unlock(c.Src, c.reply())
+	}
+}
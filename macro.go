@@ -0,0 +1,78 @@
+package folie
+
+// This file contains the user-defined ! commands, which expand into lines sent to the
+// microcontroller.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxMacroDepth limits how deeply macros can use other macros, to stop runaway recursion.
+const maxMacroDepth = 10
+
+// wrappedMacro runs a macro, with the arguments given after its name.
+func (sw *Switchboard) wrappedMacro(argv []string, lines []string, c *cmdClient) {
+	var args []string
+	if len(argv) > 1 {
+		args = strings.Fields(argv[1])
+	}
+	expanded, err := expandMacro(lines, args)
+	if err != nil {
+		fmt.Fprintf(c.Out, "%s: %s\n", argv[0], err)
+		return
+	}
+	if sw.macroDepth >= maxMacroDepth {
+		fmt.Fprintf(c.Out, "%s: macros nested too deeply\n", argv[0])
+		return
+	}
+	sw.macroDepth++
+	defer func() { sw.macroDepth-- }()
+	sw.runLines(argv[0], expanded, c)
+}
+
+// expandMacro substitutes the arguments in the lines of a macro: {1} to {9} are replaced by the
+// arguments, {*} by all of them. Unlike $1, these can't be mistaken for forth code, such as the
+// hex number $40013800. It fails if the lines refer to more arguments than were given.
+func expandMacro(lines []string, args []string) ([]string, error) {
+	var expanded []string
+	for _, line := range lines {
+		var b strings.Builder
+		for i := 0; i < len(line); i++ {
+			if line[i] != '{' || i+2 >= len(line) || line[i+2] != '}' {
+				b.WriteByte(line[i])
+				continue
+			}
+			switch c := line[i+1]; {
+			case c == '*':
+				b.WriteString(strings.Join(args, " "))
+			case c >= '1' && c <= '9':
+				n := int(c - '0')
+				if n > len(args) {
+					return nil, fmt.Errorf("missing argument {%d}", n)
+				}
+				b.WriteString(args[n-1])
+			default:
+				b.WriteByte('{')
+				continue
+			}
+			i += 2
+		}
+		expanded = append(expanded, b.String())
+	}
+	return expanded, nil
+}
+
+// showMacros lists the macros, for the help message.
+func (sw *Switchboard) showMacros(c *cmdClient) {
+	if len(sw.Macros) == 0 {
+		return
+	}
+	var names []string
+	for name := range sw.Macros {
+		names = append(names, "!"+name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(c.Out, "Macros from the config file: %s\n", strings.Join(names, " "))
+}
@@ -0,0 +1,38 @@
+package folie
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandMacro(t *testing.T) {
+	tests := []struct {
+		lines []string
+		args  string
+		want  string // expanded lines joined by "|", or the error
+	}{
+		{[]string{"1 2 + ."}, "", "1 2 + ."},
+		{[]string{"!send {1}", "{2} ."}, "app.fs 42", "!send app.fs|42 ."},
+		{[]string{"{1} {1} {2}"}, "a b c", "a a b"},
+		{[]string{"words: {*}"}, "x  y z", "words: x y z"},
+		{[]string{"[{*}]"}, "", "[]"},
+		{[]string{"{9}"}, "1 2 3 4 5 6 7 8 9", "9"},
+		{[]string{"{1}{2}"}, "a b", "ab"},
+		{[]string{"$40013800 @ . {1} $5 ."}, "x", "$40013800 @ . x $5 ."},
+		{[]string{"T{ 1 -> 1 }T", "{ a b -- }", "{0} {10} {x} {", "{1"}, "a",
+			"T{ 1 -> 1 }T|{ a b -- }|{0} {10} {x} {|{1"},
+		{[]string{"{{1}}"}, "a", "{a}"},
+		{[]string{"ok", "{2}"}, "a", "missing argument {2}"},
+		{[]string{"{1}"}, "", "missing argument {1}"},
+	}
+	for _, tt := range tests {
+		got, err := expandMacro(tt.lines, strings.Fields(tt.args))
+		s := strings.Join(got, "|")
+		if err != nil {
+			s = err.Error()
+		}
+		if s != tt.want {
+			t.Errorf("expandMacro(%q, %q) = %q, want %q", tt.lines, tt.args, s, tt.want)
+		}
+	}
+}
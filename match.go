@@ -0,0 +1,194 @@
+package folie
+
+// This file contains the matcher, which paces source lines sent to the target by waiting for
+// each one to be echoed and processed.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	firstTimeout = 3 * time.Second  // initial wait for the first reply to a line
+	gapTimeout   = time.Second      // initial wait for more data once a reply has started
+	maxTimeout   = 30 * time.Second // adaptive timeouts never grow beyond this
+)
+
+// LinesInFlight is how many lines may be sent before waiting for the reply to the oldest one.
+// Mecrisp over a plain serial port needs 1, dialects with a large enough input buffer (or flow
+// control) can handle more, which hides the round-trip time of each line.
+var LinesInFlight = 1
+
+// matcher waits for the target to process each line sent to it. It is driven entirely by data
+// arriving from the target and keeps track of how long replies take, so that its timeouts adapt
+// to slow operations such as compiling into flash.
+type matcher struct {
+	Rx      <-chan []byte // replies from the target
+	Out     io.Writer     // where to show replies, defaults to os.Stdout
+	Timeout time.Duration // deadline for the complete reply to a line after sending it, 0 to adapt
+
+	Reply    []byte // everything received for the last line
+	TimedOut bool   // the last line did not get a complete reply in time
+
+	pending    []byte        // received but not yet processed, may include later replies
+	lastData   time.Time     // when data last arrived
+	maxLatency time.Duration // slowest complete reply seen so far
+	maxGap     time.Duration // longest pause within a reply seen so far
+}
+
+// timeouts returns the current wait for the first reply to a line and for subsequent data.
+// Both are twice the slowest time seen so far, but never less than the initial values.
+func (m *matcher) timeouts() (first, gap time.Duration) {
+	first, gap = m.Timeout, gapTimeout
+	if first == 0 {
+		first = firstTimeout
+		if 2*m.maxLatency > first {
+			first = 2 * m.maxLatency
+		}
+	}
+	if 2*m.maxGap > gap {
+		gap = 2 * m.maxGap
+	}
+	if first > maxTimeout {
+		first = maxTimeout
+	}
+	if gap > maxTimeout {
+		gap = maxTimeout
+	}
+	return first, gap
+}
+
+// match waits for the target to echo the expected line, which was sent at the specified time,
+// and to process it. Everything received is shown on m.Out, except for the echo itself.
+func (m *matcher) match(expect string, sent time.Time) bool {
+	out := m.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	first, gap := m.timeouts()
+	m.Reply = m.Reply[:0]
+	m.TimedOut = false
+
+	// The first reply is due a fixed time after sending, but when lines are in flight it may
+	// take a while before this one even gets looked at, so allow at least the gap timeout.
+	wait := time.Until(sent.Add(first))
+	if wait < gap {
+		wait = gap
+	}
+	// A fixed Timeout is a hard deadline: data which keeps arriving doesn't extend it.
+	var deadline time.Time
+	if m.Timeout > 0 {
+		deadline = sent.Add(m.Timeout)
+		wait = time.Until(deadline)
+	}
+	timer := time.NewTimer(wait)
+	defer func() { timer.Stop() }()
+	for {
+		// Replies to this line may already have arrived while waiting for earlier ones.
+		if done, ok := m.process(expect, out); done {
+			if latency := time.Since(sent); latency > m.maxLatency {
+				m.maxLatency = latency
+			}
+			return ok
+		}
+
+		select {
+		case data := <-m.Rx:
+			now := time.Now()
+			since := m.lastData
+			if sent.After(since) {
+				since = sent
+			}
+			if d := now.Sub(since); d > m.maxGap && len(m.Reply) > 0 {
+				m.maxGap = d
+			}
+			m.lastData = now
+			m.pending = append(m.pending, data...)
+			m.Reply = append(m.Reply, data...)
+			putBuffer(data)
+
+			wait = gap
+			if left := time.Until(deadline); !deadline.IsZero() && left < wait {
+				wait = left
+			}
+			timer.Stop()
+			timer = time.NewTimer(wait)
+
+		case <-timer.C:
+			m.TimedOut = true
+			if len(m.Reply) > 0 && gap > m.maxGap {
+				m.maxGap = gap // a reply started but stalled, be more patient next time
+			}
+			if len(m.pending) == 0 {
+				return true
+			}
+			partial := string(m.pending)
+			m.pending = m.pending[:0]
+			fmt.Fprintf(out, "%s (timeout)\n", partial)
+			return partial == expect+" "
+		}
+	}
+}
+
+// process consumes all complete lines received so far. It returns done as soon as one of them
+// completes the reply to expect, with ok set unless the target reported a fatal error. Any data
+// following that line is kept, since it belongs to the replies to subsequent lines.
+func (m *matcher) process(expect string, out io.Writer) (done, ok bool) {
+	for {
+		n := bytes.IndexByte(m.pending, '\n')
+		if n < 0 {
+			return false, false
+		}
+		last := string(m.pending[:n])
+		m.pending = m.pending[n+1:]
+
+		hasExpected := strings.HasPrefix(last, expect+" ")
+		if !hasExpected && !strings.HasSuffix(last, " ok.") {
+			fmt.Fprintf(out, "%s\n", last)
+			continue
+		}
+		if last == expect+"  ok." {
+			return true, true
+		}
+
+		msg := last
+		// only show output if source does not start with "("
+		// ... in that case, show just the comment up to ")"
+		if hasExpected {
+			msg = last[len(expect)+1:]
+			if last[0] == '(' {
+				if n := strings.Index(expect, ")"); n > 0 {
+					msg = last[:n+1] + last[len(expect):]
+				}
+			}
+		}
+		if msg == "" {
+			return true, true // don't show empty [if]-skipped lines
+		}
+		fmt.Fprintf(out, "%s\n", msg)
+		return true, !hasFatalError(last) // no point in keeping going after an error
+	}
+}
+
+func hasFatalError(s string) bool {
+	for _, match := range []string{
+		" not found.",
+		" is compile-only.",
+		" Stack not balanced.",
+		" Stack underflow",
+		" Stack overflow",
+		" Flash full",
+		" Ram full",
+		" Structures don't match",
+		" Jump too far",
+	} {
+		if strings.HasSuffix(s, match) {
+			return true
+		}
+	}
+	return false
+}
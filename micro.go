@@ -23,23 +23,91 @@ type MicroConn interface {
 }
 
 type MicroFlasher interface {
-	Flash(pgm []byte)
+	Flash(pgm []byte) bool // returns false if flashing failed
 }
 
+// MicroForther is implemented by connections which take a whole block of forth source and feed it
+// to the microcontroller themselves, such as an SSH connection to a remote folie. This avoids
+// waiting for a network round-trip on each line. Forth returns false if sending failed.
+type MicroForther interface {
+	Forth(src []byte) bool
+}
+
+// MicroHotplug is implemented by connections to local devices, which can wait for the device to
+// reappear after being unplugged instead of having to poll for it.
+type MicroHotplug interface {
+	WaitDevice(timeout time.Duration) // return when the device exists or after the timeout
+}
+
+// ConnState is the state of the connection to the microcontroller.
+type ConnState int
+
+const (
+	Connected    ConnState = iota // connection is up
+	Disconnected                  // connection was lost, trying to reconnect
+	GaveUp                        // reconnecting took longer than ReconnectLimit
+)
+
+func (cs ConnState) String() string {
+	switch cs {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	}
+	return "gave up"
+}
+
+// ConnEvent reports a change of the connection state, or a new error while reconnecting.
+type ConnEvent struct {
+	State ConnState
+	Err   error // the reason for losing the connection or failing to reconnect
+}
+
+func (ev ConnEvent) String() string {
+	if ev.Err == nil {
+		return ev.State.String()
+	}
+	return fmt.Sprintf("%s: %s", ev.State, ev.Err)
+}
+
+// Reconnection delays, these grow exponentially between attempts.
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+// ReconnectLimit is how long to keep trying to reconnect before giving up. It's only meant for
+// non-interactive use, the default of 0 keeps trying forever.
+var ReconnectLimit time.Duration
+
 // MicroConnRunner takes a MicroConn and an rx channel. It operates a goroutine that reads
 // from the MicroConn into the channel allowing higher levels to select on that channel. It also
-// catches errors and reopens the MicroConn transparently.
+// catches errors and reopens the MicroConn transparently. Changes of the connection state are
+// sent to the events channel, or printed on stderr if it's nil.
 //
 // MicroConnRunner does not take part in the sending of data, instead, the MicroConn's Write method
 // should be called directly. It is expected that catching errors on Read is sufficient and "heals"
 // errors on the sending side quickly enough.
 //
+// When reconnecting, the delay between attempts doubles each time, up to maxReconnectDelay, so a
+// remote machine which is down doesn't get hammered. Local devices which implement MicroHotplug
+// are reopened as soon as they reappear. Once ReconnectLimit is exceeded, MicroConnRunner gives
+// up, leaving the connection closed.
+//
 // The initial opening of the connection is done synchronously so an error can be returned
 // immediately, afterwards goroutines are spawned to continue the connection(s).
-func MicroConnRunner(mc MicroConn, rx chan<- []byte) error {
+func MicroConnRunner(mc MicroConn, rx chan<- []byte, events chan<- ConnEvent) error {
 	if err := mc.Open(); err != nil {
 		return err
 	}
+	report := func(ev ConnEvent) {
+		if events != nil {
+			events <- ev
+		} else {
+			fmt.Fprintf(os.Stderr, "\n[%s]\n", ev)
+		}
+	}
 
 	// Goroutine that loops over lines and reopens the connection on error.
 	go func() {
@@ -57,21 +125,33 @@ func MicroConnRunner(mc MicroConn, rx chan<- []byte) error {
 				continue // "nothing happened" according to io.Reader
 			}
 
-			fmt.Fprintf(os.Stderr, "\n[disconnected: %s]\nreconnecting...", err)
+			report(ConnEvent{Disconnected, err})
 			mc.Close()
 
-			// Open a fresh connection
-			prevErr := err
+			// Open a fresh connection, reporting errors only when they change.
+			prevErr := err.Error()
+			delay := minReconnectDelay
+			start := time.Now()
 			for {
-				time.Sleep(500 * time.Millisecond)
+				if hp, ok := mc.(MicroHotplug); ok {
+					hp.WaitDevice(delay)
+				} else {
+					time.Sleep(delay)
+				}
 				if err = mc.Open(); err == nil {
-					fmt.Fprintln(os.Stderr, "\n[reconnected]")
+					report(ConnEvent{State: Connected})
 					break
 				}
-				if err != prevErr {
-					fmt.Fprintf(os.Stderr, "\nerror: %s\nreconnecting...", err)
-				} else {
-					fmt.Fprintln(os.Stderr, ".")
+				if ReconnectLimit > 0 && time.Since(start) > ReconnectLimit {
+					report(ConnEvent{GaveUp, err})
+					return
+				}
+				if err.Error() != prevErr {
+					report(ConnEvent{Disconnected, err})
+					prevErr = err.Error()
+				}
+				if delay *= 2; delay > maxReconnectDelay {
+					delay = maxReconnectDelay
 				}
 			}
 		}
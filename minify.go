@@ -0,0 +1,99 @@
+package folie
+
+// This file contains the optional minification of forth source before it is sent to the target.
+
+import (
+	"strings"
+)
+
+var (
+	StripSource bool // remove comments and collapse whitespace before sending source lines
+	JoinWidth   int  // join stripped lines up to this length (input buffer size), 0 to disable
+)
+
+// stringWords parse the text following them up to a delimiter. That text must be sent verbatim,
+// including any whitespace and characters that would otherwise look like comments.
+var stringWords = map[string]byte{
+	`."`:     '"',
+	`s"`:     '"',
+	`c"`:     '"',
+	`z"`:     '"',
+	`,"`:     '"',
+	`abort"`: '"',
+	`.(`:     ')',
+}
+
+// nameWords parse the next word, which must be kept even if it looks like "\" or "(".
+var nameWords = map[string]bool{
+	"char":      true,
+	"[char]":    true,
+	"'":         true,
+	"[']":       true,
+	"postpone":  true,
+	"[compile]": true,
+	":":         true,
+}
+
+// minifyLine removes "\" and "( ... )" comments from a line of forth source and collapses all
+// remaining whitespace into single spaces. It returns an empty string if nothing is left.
+func minifyLine(line string) string {
+	var words []string
+	i := 0
+	for {
+		i = skipSpace(line, i)
+		if i >= len(line) {
+			break
+		}
+		j := skipWord(line, i)
+		word := line[i:j]
+		lower := strings.ToLower(word)
+
+		switch {
+		case word == `\`:
+			return strings.Join(words, " ") // comment up to end of line
+		case word == "(":
+			if k := strings.IndexByte(line[j:], ')'); k >= 0 {
+				i = j + k + 1
+			} else {
+				i = len(line)
+			}
+			continue
+		case stringWords[lower] != 0:
+			// Keep everything up to and including the delimiter as-is, the text starts
+			// after the single space following the word.
+			end := len(line)
+			if j+1 < len(line) {
+				if k := strings.IndexByte(line[j+1:], stringWords[lower]); k >= 0 {
+					end = j + 1 + k + 1
+				}
+			}
+			words = append(words, line[i:end])
+			i = end
+			continue
+		case nameWords[lower]:
+			if k := skipSpace(line, j); k < len(line) {
+				j = skipWord(line, k)
+				word = word + " " + line[k:j]
+			}
+		}
+		words = append(words, word)
+		i = j
+	}
+	return strings.Join(words, " ")
+}
+
+// skipSpace returns the index of the first non-whitespace character at or after i.
+func skipSpace(line string, i int) int {
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// skipWord returns the index of the first whitespace character at or after i.
+func skipWord(line string, i int) int {
+	for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+		i++
+	}
+	return i
+}
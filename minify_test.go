@@ -0,0 +1,33 @@
+package folie
+
+import "testing"
+
+func TestMinifyLine(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{`\ only a comment`, ""},
+		{"1 2 +", "1 2 +"},
+		{"  1\t\t2   + ", "1 2 +"},
+		{`: double ( n -- n ) dup + ;  \ twice as much`, ": double dup + ;"},
+		{"1 ( unterminated", "1"},
+		{"1 (no-space) 2", "1 (no-space) 2"},
+		{`1 \comment-like-word 2`, `1 \comment-like-word 2`},
+		{`." hello  \ ( world" cr`, `." hello  \ ( world" cr`},
+		{`S" keep  case" type`, `S" keep  case" type`},
+		{`abort" failed  )"`, `abort" failed  )"`},
+		{`.( hi  there) 1`, `.( hi  there) 1`},
+		{`." unterminated  string`, `." unterminated  string`},
+		{`char \ emit`, `char \ emit`},
+		{`[char] ( emit`, `[char] ( emit`},
+		{`: \ ." x" ;`, `: \ ." x" ;`},
+		{`['] \ execute`, `['] \ execute`},
+	}
+	for _, tt := range tests {
+		if got := minifyLine(tt.line); got != tt.want {
+			t.Errorf("minifyLine(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
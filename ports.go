@@ -0,0 +1,152 @@
+package folie
+
+// This file contains the discovery of serial ports and the recognition of known USB adapters.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.bug.st/serial.v1/enumerator"
+)
+
+// Port describes a serial port found on this machine.
+type Port struct {
+	Name         string // device path, e.g. /dev/ttyUSB0
+	VID, PID     string // USB vendor and product IDs in hex, empty if not a USB device
+	Serial       string // USB serial number, if any
+	Manufacturer string // USB manufacturer string, if known
+	Product      string // USB product string, if known
+	Adapter      string // name of a known adapter, empty if not recognized
+	Raw          bool   // the adapter has no telnet escapes, so reset is done using DTR/RTS
+}
+
+// adapter describes a known USB serial adapter, recognized by VID/PID or by product name.
+type adapter struct {
+	vid, pid string
+	product  string // matched if not empty, it's a substring of the USB product string
+	name     string
+	raw      bool
+}
+
+// knownAdapters lists the adapters folie knows about. Only the SerPlus understands the telnet
+// escapes used to reset the microcontroller, the others get raw mode with DTR/RTS.
+var knownAdapters = []adapter{
+	{product: "SerPlus", name: "SerPlus"}, // before the VID/PID entries, it may use any
+	{vid: "10c4", pid: "ea60", name: "CP2102", raw: true},
+	{vid: "1a86", pid: "7523", name: "CH340", raw: true},
+	{vid: "0403", pid: "6001", name: "FTDI FT232R", raw: true},
+	{vid: "0403", pid: "6014", name: "FTDI FT232H", raw: true},
+	{vid: "0403", pid: "6015", name: "FTDI FT-X", raw: true},
+	{vid: "1d50", pid: "6018", name: "Black Magic Probe", raw: true},
+}
+
+// ListPorts returns the serial ports found on this machine, with USB details where available.
+// The /dev/tty.* call-in devices on macOS are left out in favour of their /dev/cu.* twins.
+func ListPorts() ([]*Port, error) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	var ports []*Port
+	for _, d := range details {
+		if strings.HasPrefix(d.Name, "/dev/tty.") {
+			continue
+		}
+		p := &Port{Name: d.Name, Product: d.Product}
+		if d.IsUSB {
+			p.VID = strings.ToLower(d.VID)
+			p.PID = strings.ToLower(d.PID)
+			p.Serial = d.SerialNumber
+		}
+		usbStrings(p)
+		for _, a := range knownAdapters {
+			if a.product != "" && strings.Contains(p.Product, a.product) ||
+				a.product == "" && a.vid == p.VID && a.pid == p.PID {
+				p.Adapter, p.Raw = a.name, a.raw
+				break
+			}
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// usbStrings fills in the manufacturer and product strings of a port on Linux, where the
+// enumerator doesn't provide them, by going up the sysfs tree to the USB device.
+func usbStrings(p *Port) {
+	dir, err := filepath.EvalSymlinks("/sys/class/tty/" + filepath.Base(p.Name) + "/device")
+	if err != nil {
+		return
+	}
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			if p.Manufacturer == "" {
+				p.Manufacturer = readSysfs(filepath.Join(dir, "manufacturer"))
+			}
+			if p.Product == "" {
+				p.Product = readSysfs(filepath.Join(dir, "product"))
+			}
+			return
+		}
+	}
+}
+
+// readSysfs returns the contents of a sysfs attribute, or an empty string.
+func readSysfs(file string) string {
+	data, _ := ioutil.ReadFile(file)
+	return strings.TrimSpace(string(data))
+}
+
+// String returns a one-line description of the port, e.g. for SelectPort.
+func (p *Port) String() string {
+	s := p.Name
+	if p.VID != "" {
+		s += fmt.Sprintf("  %s:%s", p.VID, p.PID)
+	}
+	if p.Adapter != "" {
+		s += "  " + p.Adapter
+	}
+	if desc := strings.TrimSpace(p.Manufacturer + " " + p.Product); desc != "" {
+		s += "  (" + desc + ")"
+	}
+	if p.Serial != "" {
+		s += "  sn " + p.Serial
+	}
+	return s
+}
+
+// FindPort returns the details of a local serial port, which can also be specified through a
+// symlink such as the ones in /dev/serial/by-id/. It returns nil if the port is not found.
+func FindPort(name string) *Port {
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return nil
+	}
+	ports, err := ListPorts()
+	if err != nil {
+		return nil
+	}
+	for _, p := range ports {
+		if p.Name == real || p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// FindSerial returns the port of the USB device with the specified serial number.
+func FindSerial(serial string) (*Port, error) {
+	ports, err := ListPorts()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ports {
+		if p.Serial != "" && p.Serial == serial {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no USB serial port with serial number %q", serial)
+}
@@ -0,0 +1,173 @@
+package folie
+
+// This file contains the recording of sessions and the ReplayConn, which plays them back.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recorder is a Tap which writes all traffic to a file in a format suitable for replaying with
+// ReplayConn. Each line holds the time in seconds since the recording started, the kind of chunk
+// ("rx" from the microcontroller, "tx" to it, "ev" for events), and the data as a quoted string.
+type Recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+}
+
+var _ Tap = &Recorder{} // ensure the interface is implemented
+
+// NewRecorder creates a new recording file.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{f: f, start: time.Now()}
+	fmt.Fprintf(r.f, "# folie recording %s\n", r.start.Format(time.RFC3339))
+	return r, nil
+}
+
+// Tap records one chunk of data.
+func (r *Recorder) Tap(dir byte, src string, buf []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kind := "ev"
+	switch dir {
+	case FromMicro:
+		kind = "rx"
+	case ToMicro:
+		kind = "tx"
+	}
+	fmt.Fprintf(r.f, "%.6f %s %q\n", time.Since(r.start).Seconds(), kind, buf)
+}
+
+// Close closes the recording.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.f.Close()
+}
+
+// ReplayConn implements MicroConn by playing back the output of the microcontroller from a
+// session recorded with Recorder. Anything written to it is discarded. Once the end of the
+// recording has been reached, Read blocks until the connection is closed.
+type ReplayConn struct {
+	Path  string  // recording to play back
+	Speed float64 // playback speed, 1 (or 0) is real time, 10 is ten times as fast, etc
+
+	chunks []replayChunk
+	start  time.Time
+	next   int    // index of the next chunk to return
+	rest   []byte // remainder of a chunk which didn't fit in the last Read
+	closed chan struct{}
+	once   sync.Once // closes closed only once, even if Close is called again
+}
+
+// replayChunk is a chunk of data received from the microcontroller and when it arrived.
+type replayChunk struct {
+	at   time.Duration
+	data []byte
+}
+
+var _ MicroConn = &ReplayConn{} // ensure the interface is implemented
+
+// Open loads the recording and starts playing it back from the beginning.
+func (rc *ReplayConn) Open() error {
+	f, err := os.Open(rc.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rc.chunks = nil
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: invalid recording", rc.Path, lineNo)
+		}
+		if fields[1] != "rx" {
+			continue // only output of the microcontroller is played back
+		}
+		secs, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", rc.Path, lineNo, err)
+		}
+		data, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", rc.Path, lineNo, err)
+		}
+		at := time.Duration(secs * float64(time.Second))
+		rc.chunks = append(rc.chunks, replayChunk{at: at, data: []byte(data)})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	rc.start = time.Now()
+	rc.next = 0
+	rc.rest = nil
+	rc.closed = make(chan struct{})
+	rc.once = sync.Once{}
+	return nil
+}
+
+// Close stops the playback. It can be called more than once, and the connection can be opened
+// again afterwards to play the recording back from the beginning.
+func (rc *ReplayConn) Close() error {
+	rc.once.Do(func() {
+		if rc.closed != nil {
+			close(rc.closed)
+		}
+	})
+	return nil
+}
+
+// Read returns the next chunk of recorded data once it is due.
+func (rc *ReplayConn) Read(buf []byte) (int, error) {
+	if len(rc.rest) == 0 {
+		if rc.next >= len(rc.chunks) {
+			<-rc.closed
+			return 0, io.EOF
+		}
+		chunk := rc.chunks[rc.next]
+		rc.next++
+
+		speed := rc.Speed
+		if speed <= 0 {
+			speed = 1
+		}
+		due := rc.start.Add(time.Duration(float64(chunk.at) / speed))
+		select {
+		case <-time.After(time.Until(due)):
+		case <-rc.closed:
+			return 0, io.EOF
+		}
+		rc.rest = chunk.data
+	}
+
+	n := copy(buf, rc.rest)
+	rc.rest = rc.rest[n:]
+	return n, nil
+}
+
+// Write discards the data, since the recording determines what the "microcontroller" replies.
+func (rc *ReplayConn) Write(buf []byte) (int, error) { return len(buf), nil }
+
+// Reset does nothing, but pretends to succeed.
+func (rc *ReplayConn) Reset(enterBoot bool) bool { return true }
@@ -0,0 +1,65 @@
+package folie
+
+// This file defines the roles which determine what remote clients are permitted to do.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Role determines what a remote client may do. Roles are ordered, each one includes the
+// permissions of the ones before it.
+type Role int
+
+const (
+	RoleObserve Role = iota // only receive console output
+	RoleOperate             // also type, reset the microcontroller, send packets, take the lock
+	RoleAdmin               // also upload forth source, flash firmware, and change files via SFTP
+)
+
+var roleNames = []string{"observe", "operate", "admin"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole converts a role name to a Role, "observer" and "operator" are accepted as well.
+func ParseRole(name string) (Role, error) {
+	switch strings.ToLower(name) {
+	case "observe", "observer":
+		return RoleObserve, nil
+	case "operate", "operator":
+		return RoleOperate, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return RoleObserve, fmt.Errorf("unknown role %q", name)
+}
+
+// requiredRole returns the role needed for each kind of NetInput.
+func requiredRole(what int) Role {
+	switch what {
+	case ForthIn, FlashIn:
+		return RoleAdmin
+	case UnlockIn, CommandIn:
+		return RoleObserve // disconnects must always be processed, commands check their own
+	case listMode:
+		return RoleObserve
+	}
+	return RoleOperate
+}
+
+// commandRole returns the role needed for a ! command. Commands which affect the machine folie
+// runs on, rather than just the microcontroller, are reserved for admins.
+func commandRole(cmd string) Role {
+	switch cmd {
+	case "!", "!h", "!help":
+		return RoleObserve
+	case "!c", "!cd", "!l", "!ls", "!log", "!s", "!send", "!u", "!upload", "!w", "!watch", "!run", "!script":
+		return RoleAdmin
+	}
+	return RoleOperate // also for lines which aren't commands and get sent as-is
+}
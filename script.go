@@ -0,0 +1,405 @@
+package folie
+
+// This file contains the runner for scripts, which automate bench procedures such as "reset, wait
+// for the banner, send a file, run a test word, and check its output".
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Script runs a script against the microcontroller. Scripts have one command per line, empty
+// lines and lines starting with # are ignored:
+//
+//	send <text>                  send text followed by a carriage return
+//	include <file>               send a forth source file, same as !send
+//	expect [<timeout>] <regexp>  wait for output matching regexp, fail if it doesn't show up
+//	sleep <duration>             wait, e.g. "sleep 500ms"
+//	reset                        reset the microcontroller
+//	upload <file>                upload firmware (bin, hex, or elf format), then reset
+//	log <text>                   show a message
+//	fail <text>                  stop the script with an error
+//	if [<timeout>] <regexp>      like expect, but runs the following block only if it matched,
+//	else                         ... and the block after else if it didn't
+//	end                          end of an if or loop block
+//	loop [<count>]               run the following block count times, or until break
+//	break                        leave the innermost loop
+//
+// Expect and if look at the output received since the previous match, the part up to the end of
+// the new match is then consumed. The text of send, log, and fail can refer to the last match
+// as $0 and to its submatches as $1 to $9. Text and regexps can be quoted as Go strings, to be
+// able to have leading or trailing spaces, or escapes such as \t.
+type Script struct {
+	Tx  MicroConn     // send to microcontroller
+	Rx  <-chan []byte // receive from microcontroller
+	Out io.Writer     // shows the output of the microcontroller and log messages, may be nil
+
+	// Include and Upload replace the default implementations of the include and upload
+	// commands if set, for example to use a remote folie's flashing.
+	Include func(name string) bool
+	Upload  func(data []byte) bool
+
+	received outputBuffer // output not yet consumed by expect or if
+	match    []string     // the last match and its submatches
+}
+
+// DefaultExpectTimeout is how long expect and if wait for a match if no timeout is specified.
+const DefaultExpectTimeout = 5 * time.Second
+
+// maxReceived limits how much unmatched output is kept.
+const maxReceived = 64 << 10
+
+// scriptCmd is one parsed command of a script, with the blocks of if and loop.
+type scriptCmd struct {
+	line    int
+	verb    string
+	text    string         // argument of send, include, upload, log, and fail
+	timeout time.Duration  // expect, if, and sleep
+	re      *regexp.Regexp // expect and if
+	count   int            // loop, 0 for no limit
+	body    []*scriptCmd   // block of if and loop
+	orElse  []*scriptCmd   // else block of if
+}
+
+// errBreak is returned by a break command to leave the innermost loop.
+var errBreak = errors.New("break outside of loop")
+
+// RunFile parses and runs a script file.
+func (s *Script) RunFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmds, err := parseScript(f)
+	if err != nil {
+		return fmt.Errorf("%s:%s", name, err)
+	}
+	if s.Out == nil {
+		s.Out = ioutil.Discard
+	}
+	s.received.reset()
+	s.match = nil
+	if err := s.run(cmds); err != nil {
+		return fmt.Errorf("%s:%s", name, err)
+	}
+	return nil
+}
+
+// parseScript parses all the commands of a script, checking that blocks are properly nested.
+func parseScript(r io.Reader) ([]*scriptCmd, error) {
+	var top []*scriptCmd
+	block := &top              // where commands are being added
+	var open []*scriptCmd      // if and loop commands whose end hasn't been seen yet
+	var blocks []*[]*scriptCmd // the block to return to at each end
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, err := parseCommand(line)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", lineNo, err)
+		}
+		cmd.line = lineNo
+
+		switch cmd.verb {
+		case "else":
+			if len(open) == 0 || open[len(open)-1].verb != "if" || block == &open[len(open)-1].orElse {
+				return nil, fmt.Errorf("%d: else without if", lineNo)
+			}
+			block = &open[len(open)-1].orElse
+			continue
+		case "end":
+			if len(open) == 0 {
+				return nil, fmt.Errorf("%d: end without if or loop", lineNo)
+			}
+			open = open[:len(open)-1]
+			block = blocks[len(blocks)-1]
+			blocks = blocks[:len(blocks)-1]
+			continue
+		case "break":
+			if !inLoop(open) {
+				return nil, fmt.Errorf("%d: break outside of loop", lineNo)
+			}
+		}
+		*block = append(*block, cmd)
+		if cmd.verb == "if" || cmd.verb == "loop" {
+			open = append(open, cmd)
+			blocks = append(blocks, block)
+			block = &cmd.body
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(open) > 0 {
+		cmd := open[len(open)-1]
+		return nil, fmt.Errorf("%d: %s without end", cmd.line, cmd.verb)
+	}
+	return top, nil
+}
+
+// inLoop returns true if one of the open blocks is a loop.
+func inLoop(open []*scriptCmd) bool {
+	for _, cmd := range open {
+		if cmd.verb == "loop" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCommand parses a single line.
+func parseCommand(line string) (*scriptCmd, error) {
+	verb, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		verb, arg = line[:i], strings.TrimSpace(line[i:])
+	}
+	cmd := &scriptCmd{verb: verb}
+
+	var err error
+	switch verb {
+	case "send", "log", "fail":
+		cmd.text, err = unquote(arg)
+	case "include", "upload":
+		if arg == "" {
+			return nil, fmt.Errorf("%s needs a file name", verb)
+		}
+		cmd.text, err = unquote(arg)
+	case "expect", "if":
+		cmd.timeout = DefaultExpectTimeout
+		if fields := strings.Fields(arg); len(fields) > 1 {
+			if d, err := time.ParseDuration(fields[0]); err == nil {
+				cmd.timeout = d
+				arg = strings.TrimSpace(arg[len(fields[0]):])
+			}
+		}
+		if arg == "" {
+			return nil, fmt.Errorf("%s needs a regexp", verb)
+		}
+		if arg, err = unquote(arg); err == nil {
+			cmd.re, err = regexp.Compile(arg)
+		}
+	case "sleep":
+		cmd.timeout, err = time.ParseDuration(arg)
+	case "loop":
+		if arg != "" {
+			if cmd.count, err = strconv.Atoi(arg); err == nil && cmd.count <= 0 {
+				err = fmt.Errorf("loop count must be positive")
+			}
+		}
+	case "reset", "break", "else", "end":
+		if arg != "" {
+			err = fmt.Errorf("%s takes no arguments", verb)
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", verb)
+	}
+	return cmd, err
+}
+
+// unquote removes the quotes of a quoted Go string, other text is returned as is.
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' && s[0] != '`' {
+		return s, nil
+	}
+	return strconv.Unquote(s)
+}
+
+// run executes a block of commands.
+func (s *Script) run(cmds []*scriptCmd) error {
+	for _, cmd := range cmds {
+		if err := s.exec(cmd); err != nil {
+			if err == errBreak {
+				return err
+			}
+			return fmt.Errorf("%d: %s", cmd.line, err)
+		}
+	}
+	return nil
+}
+
+// exec executes one command.
+func (s *Script) exec(cmd *scriptCmd) error {
+	switch cmd.verb {
+	case "send":
+		_, err := s.Tx.Write([]byte(s.expand(cmd.text) + "\r"))
+		return err
+	case "include":
+		s.received.reset()
+		if !s.include(cmd.text) {
+			return fmt.Errorf("sending %s failed", cmd.text)
+		}
+	case "expect":
+		if !s.expect(cmd.re, cmd.timeout) {
+			return fmt.Errorf("expected %q, no match within %s", cmd.re, cmd.timeout)
+		}
+	case "if":
+		if s.expect(cmd.re, cmd.timeout) {
+			return s.run(cmd.body)
+		}
+		return s.run(cmd.orElse)
+	case "loop":
+		for i := 0; cmd.count == 0 || i < cmd.count; i++ {
+			if err := s.run(cmd.body); err == errBreak {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	case "break":
+		return errBreak
+	case "sleep":
+		for deadline := time.Now().Add(cmd.timeout); s.receive(deadline); {
+		}
+	case "reset":
+		s.received.reset()
+		if !s.Tx.Reset(false) {
+			return fmt.Errorf("reset failed")
+		}
+	case "upload":
+		data, err := ioutil.ReadFile(cmd.text)
+		if err != nil {
+			return err
+		}
+		s.received.reset()
+		if !s.upload(data) {
+			return fmt.Errorf("uploading %s failed", cmd.text)
+		}
+	case "log":
+		fmt.Fprintf(s.Out, "[%s]\n", s.expand(cmd.text))
+	case "fail":
+		return errors.New(s.expand(cmd.text))
+	}
+	return nil
+}
+
+// expand replaces $0 to $9 in text by the last match and its submatches, and $$ by $.
+func (s *Script) expand(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '$' && i+1 < len(text) {
+			if c := text[i+1]; c == '$' {
+				b.WriteByte('$')
+				i++
+				continue
+			} else if c >= '0' && c <= '9' {
+				if n := int(c - '0'); n < len(s.match) {
+					b.WriteString(s.match[n])
+				}
+				i++
+				continue
+			}
+		}
+		b.WriteByte(text[i])
+	}
+	return b.String()
+}
+
+// expect waits for output matching re, it returns false on timeout.
+func (s *Script) expect(re *regexp.Regexp, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	match := s.received.expect(re, func() bool { return s.receive(deadline) })
+	if match == nil {
+		return false
+	}
+	s.match = make([]string, len(match))
+	for i, m := range match {
+		s.match[i] = string(m)
+	}
+	return true
+}
+
+// receive waits for output until the deadline, showing it and keeping it for expect. It
+// returns false if nothing arrived in time.
+func (s *Script) receive(deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case buf := <-s.Rx:
+		s.Out.Write(buf)
+		s.received.add(buf)
+		putBuffer(buf)
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// outputBuffer holds the output received from the microcontroller which hasn't been consumed yet,
+// for the expect of scripts and of Starlark subscriptions.
+type outputBuffer struct {
+	data []byte
+}
+
+// add appends newly received output, only the last maxReceived bytes are kept.
+func (ob *outputBuffer) add(buf []byte) {
+	ob.data = append(ob.data, buf...)
+	if len(ob.data) > maxReceived {
+		ob.data = ob.data[len(ob.data)-maxReceived:]
+	}
+}
+
+// take consumes all output and returns it.
+func (ob *outputBuffer) take() []byte {
+	data := ob.data
+	ob.data = nil
+	return data
+}
+
+// reset drops all output.
+func (ob *outputBuffer) reset() {
+	ob.data = nil
+}
+
+// expect looks for output matching re, calling receive to wait for more as long as there is no
+// match. The output up to the end of the match is consumed. It returns the match and its
+// submatches, nil for those which didn't take part, or nil if receive returns false.
+func (ob *outputBuffer) expect(re *regexp.Regexp, receive func() bool) [][]byte {
+	for {
+		if m := re.FindSubmatchIndex(ob.data); m != nil {
+			match := make([][]byte, len(m)/2)
+			for i := range match {
+				if m[2*i] >= 0 {
+					match[i] = append([]byte{}, ob.data[m[2*i]:m[2*i+1]]...)
+				}
+			}
+			ob.data = ob.data[m[1]:]
+			return match
+		}
+		if !receive() {
+			return nil
+		}
+	}
+}
+
+// include sends a source file.
+func (s *Script) include(name string) bool {
+	if s.Include != nil {
+		return s.Include(name)
+	}
+	in := &Includer{Tx: s.Tx, Rx: s.Rx, Stdout: s.Out}
+	return in.Include(name)
+}
+
+// upload uploads firmware and then resets the microcontroller to start it.
+func (s *Script) upload(data []byte) bool {
+	if s.Upload != nil {
+		return s.Upload(data)
+	}
+	u := &Uploader{Tx: s.Tx, Rx: s.Rx, Stdout: s.Out}
+	u.Upload(data)
+	s.Tx.Reset(false)
+	return !u.Failed
+}
@@ -0,0 +1,196 @@
+package folie
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line    string
+		verb    string
+		text    string
+		timeout time.Duration
+		re      string
+		count   int
+		err     bool
+	}{
+		{line: "send 1 2 + .", verb: "send", text: "1 2 + ."},
+		{line: `send "  padded\t"`, verb: "send", text: "  padded\t"},
+		{line: "send", verb: "send"},
+		{line: "log done: $1", verb: "log", text: "done: $1"},
+		{line: "include app.fs", verb: "include", text: "app.fs"},
+		{line: "include", err: true},
+		{line: "upload `my fw.bin`", verb: "upload", text: "my fw.bin"},
+		{line: "expect ok\\.$", verb: "expect", timeout: DefaultExpectTimeout, re: `ok\.$`},
+		{line: "expect 2s Mecrisp", verb: "expect", timeout: 2 * time.Second, re: "Mecrisp"},
+		{line: "expect 2s", verb: "expect", timeout: DefaultExpectTimeout, re: "2s"},
+		{line: `if 100ms "a b"`, verb: "if", timeout: 100 * time.Millisecond, re: "a b"},
+		{line: "expect", err: true},
+		{line: "expect (", err: true},
+		{line: "sleep 500ms", verb: "sleep", timeout: 500 * time.Millisecond},
+		{line: "sleep", err: true},
+		{line: "loop", verb: "loop"},
+		{line: "loop 3", verb: "loop", count: 3},
+		{line: "loop 0", err: true},
+		{line: "loop x", err: true},
+		{line: "reset", verb: "reset"},
+		{line: "reset now", err: true},
+		{line: "break 2", err: true},
+		{line: "bogus", err: true},
+	}
+	for _, tt := range tests {
+		cmd, err := parseCommand(tt.line)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseCommand(%q) succeeded, want error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCommand(%q) failed: %s", tt.line, err)
+			continue
+		}
+		re := ""
+		if cmd.re != nil {
+			re = cmd.re.String()
+		}
+		if cmd.verb != tt.verb || cmd.text != tt.text || cmd.timeout != tt.timeout ||
+			re != tt.re || cmd.count != tt.count {
+			t.Errorf("parseCommand(%q) = %s %q %s %q %d, want %s %q %s %q %d", tt.line,
+				cmd.verb, cmd.text, cmd.timeout, re, cmd.count,
+				tt.verb, tt.text, tt.timeout, tt.re, tt.count)
+		}
+	}
+}
+
+// outline summarises parsed commands as their verbs, with blocks in parentheses.
+func outline(cmds []*scriptCmd) string {
+	var verbs []string
+	for _, cmd := range cmds {
+		v := cmd.verb
+		if cmd.verb == "if" || cmd.verb == "loop" {
+			v += "(" + outline(cmd.body)
+			if cmd.orElse != nil {
+				v += " | " + outline(cmd.orElse)
+			}
+			v += ")"
+		}
+		verbs = append(verbs, v)
+	}
+	return strings.Join(verbs, " ")
+}
+
+func TestParseScript(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string // outline of the commands, or the error
+	}{
+		{"", ""},
+		{"# comment\n\n  send x  \n", "send"},
+		{"reset\nexpect ok\nsend 1", "reset expect send"},
+		{"if a\nlog yes\nend", "if(log)"},
+		{"if a\nlog yes\nelse\nlog no\nend\nsend", "if(log | log) send"},
+		{"loop\nif done\nbreak\nend\nsleep 1s\nend", "loop(if(break) sleep)"},
+		{"loop 2\nloop\nbreak\nend\nend", "loop(loop(break))"},
+		{"send\nbogus", "2: unknown command \"bogus\""},
+		{"else", "1: else without if"},
+		{"loop\nelse\nend", "2: else without if"},
+		{"if a\nelse\nelse\nend", "3: else without if"},
+		{"end", "1: end without if or loop"},
+		{"send\nif a\nsend", "2: if without end"},
+		{"loop\nif a\nend", "1: loop without end"},
+		{"break", "1: break outside of loop"},
+		{"if a\nbreak\nend", "2: break outside of loop"},
+		{"loop\nend\nbreak", "3: break outside of loop"},
+	}
+	for _, tt := range tests {
+		cmds, err := parseScript(strings.NewReader(tt.src))
+		got := outline(cmds)
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("parseScript(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestScriptExpand(t *testing.T) {
+	s := &Script{match: []string{"v1.2", "1", "2"}}
+	tests := []struct {
+		text, want string
+	}{
+		{"", ""},
+		{"no dollars", "no dollars"},
+		{"version $0", "version v1.2"},
+		{"$1.$2", "1.2"},
+		{"$3 is empty", " is empty"},
+		{"costs $$5", "costs $5"},
+		{"$x and $", "$x and $"},
+		{"$$1", "$1"},
+	}
+	for _, tt := range tests {
+		if got := s.expand(tt.text); got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+	if got := (&Script{}).expand("no match $0"); got != "no match " {
+		t.Errorf("expand without a match = %q", got)
+	}
+}
+
+func TestOutputBufferExpect(t *testing.T) {
+	tests := []struct {
+		chunks []string // output arriving each time expect waits for more
+		re     string
+		want   []string // match and submatches, "<nil>" if they didn't take part
+		rest   string   // output left afterwards
+	}{
+		{[]string{"1 2 +  ok.\n"}, `ok\.`, []string{"ok."}, "\n"},
+		{[]string{"Mecr", "isp 2.5", "\nok"}, `Mecrisp ([0-9.]+)\n`,
+			[]string{"Mecrisp 2.5\n", "2.5"}, "ok"},
+		{[]string{"abc"}, `a(x)?(b*)`, []string{"ab", "<nil>", "b"}, "c"},
+		{[]string{"abc"}, `q*`, []string{""}, ""}, // matches without waiting for output
+		{[]string{"abc", "def"}, `xyz`, nil, "abcdef"},
+		{nil, `.`, nil, ""},
+	}
+	for _, tt := range tests {
+		var ob outputBuffer
+		chunks := tt.chunks
+		receive := func() bool {
+			if len(chunks) == 0 {
+				return false
+			}
+			ob.add([]byte(chunks[0]))
+			chunks = chunks[1:]
+			return true
+		}
+		var got []string
+		for _, m := range ob.expect(regexp.MustCompile(tt.re), receive) {
+			s := string(m)
+			if m == nil {
+				s = "<nil>"
+			}
+			got = append(got, s)
+		}
+		if (got == nil) != (tt.want == nil) ||
+			strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("expect(%q) on %q = %q, want %q", tt.re, tt.chunks, got, tt.want)
+		}
+		if rest := string(ob.take()); rest != tt.rest {
+			t.Errorf("expect(%q) on %q left %q, want %q", tt.re, tt.chunks, rest, tt.rest)
+		}
+	}
+}
+
+func TestOutputBufferLimit(t *testing.T) {
+	var ob outputBuffer
+	ob.add(make([]byte, maxReceived))
+	ob.add([]byte("end"))
+	if data := ob.take(); len(data) != maxReceived || string(data[len(data)-3:]) != "end" {
+		t.Errorf("kept %d bytes ending in %q", len(data), data[len(data)-3:])
+	}
+}
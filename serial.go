@@ -9,12 +9,14 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/chzyer/readline"
+	"github.com/fsnotify/fsnotify"
 	"go.bug.st/serial.v1"
 )
 
@@ -36,7 +38,7 @@ var _ MicroConn = &SerialConn{} // ensure the interface is implemented
 
 // Open connects to the serial device and initializes the baud rate as well as RTS & DTR.
 func (sc *SerialConn) Open() error {
-	if sc.intPath == "" {
+	if !strings.HasPrefix(sc.intPath, byIDPrefix) {
 		sc.intPath = switchDev(sc.Path)
 	}
 	if sc.Baud == 0 {
@@ -56,6 +58,9 @@ func (sc *SerialConn) Open() error {
 // Close closes the connection.
 func (sc *SerialConn) Close() error { return sc.tty.Close() }
 
+// WaitDevice waits for the serial device to reappear, see MicroHotplug.
+func (sc *SerialConn) WaitDevice(timeout time.Duration) { waitDevice(sc.intPath, timeout) }
+
 // Read bytes from the connection.
 func (sc *SerialConn) Read(buf []byte) (int, error) { return sc.tty.Read(buf) }
 
@@ -94,22 +99,15 @@ func (sc *SerialConn) Reset(enterBoot bool) bool {
 }
 
 // SelectPort enumerates available ports, prompts for a choice, and returns the chosen port name.
-// It returns an empty string if nothing useful was chosen.
+// USB details are shown to tell boards apart, along with the name of the adapter if it's a known
+// one. It returns an empty string if nothing useful was chosen.
 func SelectPort(console *readline.Instance) string {
-	allPorts, err := serial.GetPortsList()
+	ports, err := ListPorts()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return ""
 	}
 
-	var ports []string
-	for _, p := range allPorts {
-		if !strings.HasPrefix(p, "/dev/tty.") {
-			ports = append(ports, p)
-		}
-	}
-	//sort.Strings(ports)
-
 	if len(ports) == 0 {
 		fmt.Fprintln(os.Stderr, "No serial ports found.")
 		return ""
@@ -130,7 +128,7 @@ func SelectPort(console *readline.Instance) string {
 		fmt.Fprintln(console.Stdout(), reply)
 
 		if sel, _ := strconv.Atoi(reply); sel > 0 && sel <= len(ports) {
-			return ports[sel-1]
+			return ports[sel-1].Name
 		}
 		fmt.Fprintln(console.Stdout(), "Enter number of desired port or ctrl-d to quit.")
 	}
@@ -138,7 +136,8 @@ func SelectPort(console *readline.Instance) string {
 
 // switchDev switches a /dev/ttyXXX path to /dev/serial/by-id/YYY in order to allow reopening
 // the device when it's reset or unplugged and replugged. It returns the mapped port name or the
-// provided name if no mapping could be found.
+// provided name if no mapping could be found. Connections keep trying to map the path each time
+// they open the device until this succeeds, since the by-id entry may not exist at the start.
 func switchDev(devicePath string) string {
 	if dir, err := os.Open(byIDPrefix); err == nil {
 		names, _ := dir.Readdirnames(-1)
@@ -154,3 +153,48 @@ func switchDev(devicePath string) string {
 	}
 	return devicePath
 }
+
+// waitDevice waits until the device at path is created, for example when a board is plugged back
+// in, or until the timeout expires. The directory is watched, so this doesn't need polling. It
+// may not exist either, /dev/serial/by-id goes away with the last USB serial device, in which
+// case the closest parent is watched instead. If the device is there, the whole timeout is
+// waited, since evidently it can't be opened yet.
+func waitDevice(path string, timeout time.Duration) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		time.Sleep(timeout)
+		return
+	}
+	defer fsw.Close()
+	watch := func() {
+		dir := filepath.Dir(path)
+		for fsw.Add(dir) != nil && dir != filepath.Dir(dir) {
+			dir = filepath.Dir(dir)
+		}
+	}
+	watch()
+	if _, err := os.Stat(path); err == nil {
+		time.Sleep(timeout)
+		return
+	}
+
+	expire := time.After(timeout)
+	for {
+		select {
+		case ev, ok := <-fsw.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				watch() // the directory of the device may have been created
+				if _, err := os.Stat(path); err == nil {
+					return
+				}
+			}
+		case <-fsw.Errors:
+			// ignore, the timeout takes care of it
+		case <-expire:
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package folie
+
+// This file contains the SFTP subsystem of the SSH server, which gives remote clients access to
+// the files in a single directory.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpRoot implements the sftp request handlers on top of a directory. All paths are taken to be
+// relative to the directory and symbolic links can't lead out of it, so clients cannot get out of
+// it. Clients which aren't allowed to change anything only get to list and read files.
+type sftpRoot struct {
+	dir      string
+	readOnly bool
+}
+
+// serveSFTP runs an SFTP session on channel until the client is done.
+func serveSFTP(channel io.ReadWriteCloser, dir string, readOnly bool) error {
+	root := &sftpRoot{dir: dir, readOnly: readOnly}
+	handlers := sftp.Handlers{FileGet: root, FilePut: root, FileCmd: root, FileList: root}
+	server := sftp.NewRequestServer(channel, handlers)
+	defer server.Close()
+
+	if err := server.Serve(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// localPath maps a path as seen by the client to a path in the directory, see rootedPath.
+func (r *sftpRoot) localPath(name string) (string, error) {
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		rel = "."
+	}
+	p, err := rootedPath(r.dir, r.dir, filepath.FromSlash(rel))
+	if err != nil {
+		return "", &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return p, nil
+}
+
+// Fileread opens a file for reading.
+func (r *sftpRoot) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	name, err := r.localPath(req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// Filewrite opens a file for writing, creating it if needed.
+func (r *sftpRoot) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	if r.readOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	name, err := r.localPath(req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if pf := req.Pflags(); pf.Trunc {
+		flags |= os.O_TRUNC
+	}
+	return os.OpenFile(name, flags, 0644)
+}
+
+// Filecmd performs operations which change the directory. Links are not supported, they might
+// point outside of the directory.
+func (r *sftpRoot) Filecmd(req *sftp.Request) error {
+	if r.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	name, err := r.localPath(req.Filepath)
+	if err != nil {
+		return err
+	}
+	switch req.Method {
+	case "Setstat":
+		if req.AttrFlags().Size {
+			return os.Truncate(name, int64(req.Attributes().Size))
+		}
+		return nil // other attributes are not preserved
+	case "Rename":
+		target, err := r.localPath(req.Target)
+		if err != nil {
+			return err
+		}
+		return os.Rename(name, target)
+	case "Rmdir", "Remove":
+		return os.Remove(name)
+	case "Mkdir":
+		return os.Mkdir(name, 0755)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// Filelist lists a directory or returns information about a single file.
+func (r *sftpRoot) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	name, err := r.localPath(req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Method {
+	case "List":
+		files, err := ioutil.ReadDir(name)
+		return fileList(files), err
+	case "Stat":
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return fileList{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// fileList implements sftp.ListerAt.
+type fileList []os.FileInfo
+
+func (fl fileList) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(fl)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, fl[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readFile reads a file from the directory made available via SFTP, for example to flash it.
+func readFile(dir, name string) ([]byte, error) {
+	p, err := (&sftpRoot{dir: dir}).localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+// readForth reads a forth source file from the directory made available via SFTP, expanding its
+// include lines, which can only refer to files in the same directory.
+func readForth(dir, name string) ([]byte, error) {
+	p, err := (&sftpRoot{dir: dir}).localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	var code bytes.Buffer
+	in := &Includer{Tx: &code, DryRun: true, Root: dir}
+	if !in.Include(p) {
+		return nil, fmt.Errorf("expanding %s failed", name)
+	}
+	return code.Bytes(), nil
+}
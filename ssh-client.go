@@ -1,16 +1,20 @@
 package folie
 
-// This file contains the SSH server.
+// This file contains the SSH client.
 
 import (
 	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/chzyer/readline"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
@@ -18,52 +22,189 @@ import (
 // input. Locally it takes the place of a serial port or telnet connection. Therefore SSHClient
 // implements MicroConn.
 type SSHClient struct {
-	addr   string
-	client *ssh.Client
-	config *ssh.ClientConfig
+	addr       string
+	client     *ssh.Client
+	config     *ssh.ClientConfig
+	knownHosts string             // known_hosts file to verify the host key with
+	console    *readline.Instance // to ask the user, nil once the console is in use
 	//addTxWriter func(io.Writer)
 	session            *ssh.Session
-	txReader, rxReader io.Reader
-	txWriter, rxWriter io.Writer
+	txReader, rxReader *io.PipeReader
+	txWriter, rxWriter *io.PipeWriter
 }
 
-func (sc *SSHClient) Reset(bootloader bool) bool { return false }
-func (sc *SSHClient) Close() error               { return nil }
+var _ MicroForther = &SSHClient{} // ensure the interface is implemented
 
 // NewSSHClient prepares the crypto info to connect to a remote folie process via SSH. It returns an
 // SSHClient on which Open can be called multiple times to open an re-open the connection.
-func NewSSHClient(addr string) (*SSHClient, error) {
+//
+// The address has the form [user@]host[:port], where host may also be a Host alias from
+// ~/.ssh/config, whose HostName, Port, User, and IdentityFile settings are then used. The client
+// authenticates with the keys held by ssh-agent, if SSH_AUTH_SOCK is set, and with keyFile or
+// else the identity files from the config file or the default ~/.ssh/id_* keys. Default keys
+// which can't be loaded are skipped with a warning. The console is used to prompt for
+// passphrases and to confirm unknown host keys.
+func NewSSHClient(addr, keyFile string, console *readline.Instance) (*SSHClient, error) {
 	home := os.Getenv("HOME")
-	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
-	hostKeyCallback, err := knownhosts.New(knownHosts)
+
+	// Split the address and fill in the blanks from ~/.ssh/config.
+	user := ""
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		user, addr = addr[:i], addr[i+1:]
+	}
+	host, port := addr, ""
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host, port = h, p
+	}
+	hc, err := readSSHConfig(filepath.Join(home, ".ssh", "config"), host)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot read SSH config: %s", err)
+	}
+	if hc.HostName != "" {
+		host = hc.HostName
+	}
+	if port == "" {
+		port = hc.Port
+	}
+	if port == "" {
+		port = "22"
+	}
+	if user == "" {
+		user = hc.User
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	// Collect the authentication methods, starting with ssh-agent.
+	var auth []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			fmt.Fprintf(os.Stderr, "[ssh: cannot use agent: %s]\n", err)
+		}
 	}
 
-	// Assume unencrypted private key...
-	keyFile := filepath.Join(home, ".ssh", "tve-2016")
-	key, err := ioutil.ReadFile(keyFile)
+	keyFiles := hc.IdentityFiles
+	if keyFile != "" {
+		keyFiles = []string{ExpandHome(keyFile)}
+	}
+	explicit := len(keyFiles) > 0
+	if !explicit {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, f := range keyFiles {
+		signer, err := loadClientKey(f, console)
+		switch {
+		case err == nil:
+			signers = append(signers, signer)
+		case explicit:
+			return nil, err
+		case !os.IsNotExist(err):
+			// Default keys are only tried, e.g. the agent may well hold an encrypted one.
+			fmt.Fprintf(os.Stderr, "[ssh: skipping key %s: %s]\n", f, err)
+		}
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no usable SSH keys found, use -i to specify one")
+	}
+
+	sc := &SSHClient{addr: net.JoinHostPort(host, port), console: console}
+	sc.knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	sc.config = &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: sc.checkHostKey,
+		ClientVersion:   "SSH-2.0-JeeLabs-folie",
+		Auth:            auth,
+	}
+	return sc, nil
+}
+
+// loadClientKey reads a private key, prompting for its passphrase if it's encrypted.
+func loadClientKey(file string, console *readline.Instance) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(file)
 	if err != nil {
-		return nil, fmt.Errorf("cannot open SSH key file %s: %s", keyFile, err)
+		return nil, err
 	}
 	signer, err := ssh.ParsePrivateKey(key)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok && console != nil {
+		prompt := fmt.Sprintf("Enter passphrase for key %s: ", file)
+		passphrase, err2 := console.ReadPassword(prompt)
+		if err2 != nil {
+			return nil, fmt.Errorf("cannot read passphrase: %s", err2)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse SSH key file %s: %s", keyFile, err)
+		return nil, fmt.Errorf("cannot parse SSH key file %s: %s", file, err)
+	}
+	return signer, nil
+}
+
+// checkHostKey verifies the host key of the remote folie against ~/.ssh/known_hosts. If the host
+// is not known at all, the user is asked whether to trust the key, which is then added to the
+// file. This is only possible when first connecting, since afterwards the console is in use.
+func (sc *SSHClient) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	// Re-read the file each time, it may have been changed by an earlier call.
+	if _, err := os.Stat(sc.knownHosts); os.IsNotExist(err) {
+		os.MkdirAll(filepath.Dir(sc.knownHosts), 0700)
+		ioutil.WriteFile(sc.knownHosts, nil, 0600)
+	}
+	callback, err := knownhosts.New(sc.knownHosts)
+	if err != nil {
+		return err
+	}
+	err = callback(hostname, remote, key)
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok || len(keyErr.Want) > 0 || sc.console == nil {
+		return err // accepted, a mismatch, or nobody to ask
 	}
 
-	config := &ssh.ClientConfig{
-		HostKeyCallback: hostKeyCallback,
-		ClientVersion:   "JeeLabs folie",
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	// Trust on first use, if the user agrees.
+	console := sc.console
+	fmt.Fprintf(console.Stdout(), "The authenticity of host %s can't be established.\n", hostname)
+	fmt.Fprintf(console.Stdout(), "%s key fingerprint is %s.\n", key.Type(),
+		ssh.FingerprintSHA256(key))
+	for {
+		console.SetPrompt("Are you sure you want to continue connecting (yes/no)? ")
+		console.Refresh()
+		reply, err := console.Readline()
+		console.SetPrompt("")
+		if err != nil || reply == "no" {
+			return fmt.Errorf("host key verification failed")
+		}
+		if reply == "yes" {
+			break
+		}
 	}
-	return &SSHClient{addr: addr, config: config}, nil
+
+	f, err := os.OpenFile(sc.knownHosts, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err = fmt.Fprintln(f, line); err != nil {
+		return err
+	}
+	fmt.Fprintf(console.Stdout(), "Permanently added %s to %s.\n", hostname, sc.knownHosts)
+	return nil
 }
 
 // Open dials the SSH connection to the remote folie server. It also requests and interactive shell
 // session.
 func (sc *SSHClient) Open() error {
-	// Dial the connection.
+	// Dial the connection. Only the initial connection can prompt for an unknown host key, later
+	// on the console is busy reading input.
 	client, err := ssh.Dial("tcp", sc.addr, sc.config)
+	sc.console = nil
 	if err != nil {
 		return fmt.Errorf("failed to dial %s: %s", sc.addr, err)
 	}
@@ -88,25 +229,90 @@ func (sc *SSHClient) Open() error {
 		return fmt.Errorf("failed to start shell session: %s", err)
 	}
 
+	// Make Read fail once the session ends, so MicroConnRunner notices and reconnects.
+	go func(sess *ssh.Session, w *io.PipeWriter) {
+		err := sess.Wait()
+		if _, ok := err.(*ssh.ExitMissingError); ok || err == nil {
+			err = io.EOF
+		}
+		w.CloseWithError(err)
+	}(sc.session, sc.rxWriter)
+
 	return nil
 }
 
 func (sc *SSHClient) Read(buf []byte) (int, error)  { return sc.rxReader.Read(buf) }
 func (sc *SSHClient) Write(buf []byte) (int, error) { return sc.txWriter.Write(buf) }
 
-func (sc *SSHClient) Flash(pgm []byte) {
+// Close tears down the shell session and the connection, so that Open can start afresh.
+func (sc *SSHClient) Close() error {
+	if sc.session != nil {
+		sc.session.Close()
+	}
+	if sc.txWriter != nil {
+		sc.txWriter.Close()
+		sc.rxWriter.Close()
+	}
+	if sc.client == nil {
+		return nil
+	}
+	return sc.client.Close()
+}
+
+// Reset asks the remote folie to reset the microcontroller. Entering the bootloader is not
+// supported remotely, use Flash instead.
+func (sc *SSHClient) Reset(bootloader bool) bool {
+	if bootloader {
+		return false
+	}
+	if err := sc.run("reset", nil); err != nil {
+		fmt.Fprintf(sc.rxWriter, "Error resetting: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// Flash ships firmware to the remote folie, which uploads it to the microcontroller. It returns
+// false if the upload failed.
+func (sc *SSHClient) Flash(pgm []byte) bool {
+	if err := sc.run("flash", pgm); err != nil {
+		fmt.Fprintf(sc.rxWriter, "Error flashing: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// Forth ships a block of expanded forth source to the remote folie, which sends it on to the
+// microcontroller line by line.
+func (sc *SSHClient) Forth(src []byte) bool {
+	if err := sc.run("forth", src); err != nil {
+		fmt.Fprintf(sc.rxWriter, "Error sending: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// run runs a command on the remote folie in a separate session, this blocks until it's done.
+// Any output of the command is shown as if it came from the microcontroller.
+func (sc *SSHClient) run(cmd string, input []byte) error {
+	if sc.client == nil {
+		return fmt.Errorf("not connected")
+	}
 	sess, err := sc.client.NewSession()
 	if err != nil {
-		fmt.Fprintf(sc.rxWriter, "Error flashing: %s\n", err)
-		return
+		return err
 	}
+	defer sess.Close()
 
-	sess.Stdin = bytes.NewReader(pgm)
+	if input != nil {
+		sess.Stdin = bytes.NewReader(input)
+	}
 	sess.Stdout = sc.rxWriter
+	sess.Stderr = sc.rxWriter // permission problems are reported on stderr
 
-	// Run the flashing session, this blocks until it's done.
-	if err = sess.Run("flash"); err != nil {
-		fmt.Fprintf(sc.rxWriter, "Error flashing: %s\n", err)
-		return
+	err = sess.Run(cmd)
+	if _, ok := err.(*ssh.ExitMissingError); ok {
+		err = fmt.Errorf("%s: no exit status, the connection may have dropped", cmd)
 	}
+	return err
 }
@@ -8,50 +8,55 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
 // SSHServer represents an instance of an SSH server that accepts incoming connections that
 // gain access to the serial port managed by folie.
 type SSHServer struct {
-	listener    net.Listener
-	sshConfig   *ssh.ServerConfig
-	addTxWriter func(io.Writer)
+	AuthKeys *AuthorizedKeys // authorized client keys, nil if authentication is disabled
+	Files    string          // directory accessible via SFTP and flash/forth execs, "" for none
+
+	listener  net.Listener
+	sshConfig *ssh.ServerConfig
+	boards    Boards
 }
 
 // NewSSHServer creates a new SSHServer, opens the listening socket, and validates that the
-// server key and authorized keys files can be read.
+// server key and authorized keys files can be read. If serverKeyFile is empty, folie's own
+// host key in the state directory is used, it is generated when first needed.
 func NewSSHServer(listenAddr, serverKeyFile, authorizedKeysFile string) (*SSHServer, error) {
 	config := &ssh.ServerConfig{}
+	var err error
 
 	// Set-up authorized client keys.
+	var authKeys *AuthorizedKeys
 	if authorizedKeysFile == "insecure" {
 		config.NoClientAuth = true
 	} else {
-		keyMap, err := readAuthorizedKeys(authorizedKeysFile)
+		authKeys, err = NewAuthorizedKeys(authorizedKeysFile)
 		if err != nil {
 			return nil, err
 		}
-		config.PublicKeyCallback = func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			if _, ok := keyMap[string(pubKey.Marshal())]; ok {
-				return nil, nil
-			}
-			return nil, fmt.Errorf("unknown public key for %q", c.User())
-		}
+		config.PublicKeyCallback = authKeys.Authenticate
 	}
 
-	// Set-up host key.
-	privateBytes, err := ioutil.ReadFile(serverKeyFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load host key from %s: %s", serverKeyFile, err)
+	// Set-up host key, generating one of our own if none is specified.
+	var private ssh.Signer
+	if serverKeyFile == "" {
+		private, err = defaultHostKey()
+	} else {
+		private, err = loadHostKey(serverKeyFile)
 	}
-
-	private, err := ssh.ParsePrivateKey(privateBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse host key from %s: %s", serverKeyFile, err)
+		return nil, err
 	}
 	config.AddHostKey(private)
+	fmt.Fprintf(os.Stderr, "[ssh: host key %s %s]\n", private.PublicKey().Type(),
+		ssh.FingerprintSHA256(private.PublicKey()))
 
 	// Create the listener socket.
 	listener, err := net.Listen("tcp", listenAddr)
@@ -59,15 +64,18 @@ func NewSSHServer(listenAddr, serverKeyFile, authorizedKeysFile string) (*SSHSer
 		return nil, fmt.Errorf("failed to listen on %s: %s", listenAddr, err)
 	}
 
-	return &SSHServer{listener: listener, sshConfig: config}, nil
+	return &SSHServer{listener: listener, sshConfig: config, AuthKeys: authKeys}, nil
 }
 
 // Run is an infinite loop that accepts incoming connections. For each connection it starts a
-// goroutine that reads on the connection and pushes bytes into the rx channel (which is shared
-// across all). It also makes a callback to ss.addTxWriter to register the SSH channel with the
-// switchboard for transmission.
-func (ss *SSHServer) Run(rx chan<- NetInput, addTxWriter func(io.Writer)) {
-	ss.addTxWriter = addTxWriter
+// goroutine that reads on the connection and pushes bytes into the network input of the selected
+// board (which is shared across all clients of that board). It also registers the SSH channel
+// with the board's switchboard for transmission.
+//
+// Clients select a board by using its name as SSH user name, e.g. "ssh f103-a@bench", or as
+// first exec argument, e.g. "ssh bench f103-a reset", else they get the first board.
+func (ss *SSHServer) Run(boards Boards) {
+	ss.boards = boards
 	// Run the accept loop, it ends with os.Exit...
 	for {
 		// Accept a connection.
@@ -79,42 +87,46 @@ func (ss *SSHServer) Run(rx chan<- NetInput, addTxWriter func(io.Writer)) {
 		fmt.Fprintf(os.Stderr, "\n[Accepted SSH from %s]\n", conn.RemoteAddr())
 
 		// Start goroutine to service the connection.
-		go ss.service(conn, rx)
+		go ss.service(conn)
 	}
 }
 
-//
-
-// readAuthorizedKeys reads an authorized keys file and returns a hash with the keys.
-func readAuthorizedKeys(file string) (map[string]struct{}, error) {
-	authorizedKeysBytes, err := ioutil.ReadFile("authorized_keys")
-	if err != nil {
-		return nil, fmt.Errorf("failed to load authorized keys from %s: %v", file, err)
-	}
-
-	authorizedKeysMap := map[string]struct{}{}
-	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing authorized keys from %s: %v", file, err)
-		}
+// Modes of channels which don't send anything to the switchboard, they're not kinds of NetInput.
+const (
+	sftpMode = -2 // running the SFTP subsystem
+	listMode = -3 // listing the boards
+)
 
-		authorizedKeysMap[string(pubKey.Marshal())] = struct{}{}
-		authorizedKeysBytes = rest
+// connRole returns the role of an authenticated connection.
+func connRole(conn *ssh.ServerConn) Role {
+	if conn.Permissions == nil || conn.Permissions.Extensions[roleOption] == "" {
+		return RoleAdmin // no authentication, i.e. "insecure"
 	}
-
-	return authorizedKeysMap, nil
+	role, _ := ParseRole(conn.Permissions.Extensions[roleOption])
+	return role
 }
 
 // service initalizes a connection and then services it.
-func (ss *SSHServer) service(conn net.Conn, rx chan<- NetInput) { //, cmd chan string) {
+func (ss *SSHServer) service(conn net.Conn) {
 	// Perform SSH handshake. newChan is a channel where new SSH channel open requests come int
 	// and reqChan is where out-of-band requests come in.
-	_, newChan, reqChan, err := ssh.NewServerConn(conn, ss.sshConfig)
+	sshConn, newChan, reqChan, err := ssh.NewServerConn(conn, ss.sshConfig)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed SSH handshake: %s\n", err)
 		return // the connection is already closed by NewServerConn
 	}
+	from := fmt.Sprintf("ssh:%s@%s", sshConn.User(), sshConn.RemoteAddr())
+	role := connRole(sshConn)
+	if sshConn.Permissions != nil {
+		fmt.Fprintf(os.Stderr, "[ssh: %s authenticated with %s, role %s]\n", from,
+			sshConn.Permissions.Extensions[fingerprintExt], role)
+	} else {
+		fmt.Fprintf(os.Stderr, "[ssh: %s not authenticated, role %s]\n", from, role)
+	}
+	board := ss.boards.Find(sshConn.User())
+	if board == nil {
+		board = ss.boards[0]
+	}
 
 	// We discard incoming requests at the connection level.
 	go ssh.DiscardRequests(reqChan)
@@ -136,7 +148,15 @@ func (ss *SSHServer) service(conn net.Conn, rx chan<- NetInput) { //, cmd chan s
 		// Create a semaphore to unblock reading of input on the channel only after
 		// we get a shell or exec request so we know what we're supposed to do.
 		ready := make(chan struct{}, 0)
-		mode := -1 // by default we drop
+		mode := -1             // by default we drop
+		file := ""             // file argument of a flash or forth exec
+		b := board             // board this channel talks to
+		var tty *term.Terminal // line editing for interactive shells, if a pty was requested
+		interrupt := func(w io.Writer) {
+			// Same as ctrl-c on the local console, but it also gets through while a command
+			// of this client is running, see hold.
+			b.Input <- NetInput{What: ResetIn, From: from, Reply: w, Role: role}
+		}
 
 		// Incoming requests are used for out-of-band commands, for example to reset the
 		// attached uC or change the baud rate. We also need to handle the "shell" request
@@ -145,33 +165,110 @@ func (ss *SSHServer) service(conn net.Conn, rx chan<- NetInput) { //, cmd chan s
 			for req := range requests {
 				switch req.Type {
 				case "shell": // used by std SSH clients to get started without command name
-					fmt.Fprintf(os.Stderr, "[ssh: shell]\n")
+					fmt.Fprintf(os.Stderr, "[ssh: shell on %s]\n", b.Name)
 					req.Reply(true, nil)
 					mode = RawIn
 					close(ready)
 				case "exec": // used by std SSH clients to get started with command name
-					switch string(req.Payload) {
-					case "\x00\x00\x00\x05flash":
-						fmt.Fprintf(os.Stderr, "[ssh: flash]\n")
+					var exec struct{ Command string }
+					ssh.Unmarshal(req.Payload, &exec)
+					args := strings.Fields(exec.Command)
+					if len(args) > 0 && ss.boards.Find(args[0]) != nil {
+						b = ss.boards.Find(args[0])
+						args = args[1:]
+						if len(args) == 0 {
+							mode = RawIn // just the board name, same as a shell
+						}
+					}
+					if len(args) == 0 {
+						args = []string{""}
+					}
+					switch args[0] {
+					case "flash":
 						mode = FlashIn
-					case "\x00\x00\x00\x05forth":
-						fmt.Fprintf(os.Stderr, "[ssh: forth]\n")
+					case "forth":
 						mode = ForthIn
-					case "\x00\x00\x00\x06packet":
-						fmt.Fprintf(os.Stderr, "[ssh: packet]\n")
+					case "packet":
 						mode = PacketIn
-					case "\x00\x00\x00\x05reset":
-						fmt.Fprintf(os.Stderr, "[ssh: reset]\n")
+					case "reset":
 						mode = ResetIn
-					default:
-						fmt.Fprintf(os.Stderr, "[ssh: invalid exec: %q]\n",
-							string(req.Payload))
+					case "lock":
+						mode = LockIn
+					case "unlock":
+						mode = UnlockIn
+					case "list":
+						mode = listMode
+					}
+					// Only flash and forth take an argument, a file from the SFTP directory.
+					if len(args) == 2 && (mode == FlashIn || mode == ForthIn) && ss.Files != "" {
+						file = args[1]
+						args = args[:1]
+					}
+					if mode == -1 || len(args) > 1 {
+						fmt.Fprintf(os.Stderr, "[ssh: invalid exec: %q]\n", exec.Command)
+						req.Reply(false, nil)
+						channel.Close()
+						return
+					}
+					fmt.Fprintf(os.Stderr, "[ssh: %s on %s]\n", exec.Command, b.Name)
+					if need := requiredRole(mode); role < need {
+						fmt.Fprintf(os.Stderr, "[ssh: denied, %s has role %s]\n", from, role)
+						fmt.Fprintf(channel.Stderr(), "permission denied, %s role required\n", need)
 						req.Reply(false, nil)
 						channel.Close()
 						return
 					}
 					req.Reply(true, nil)
 					close(ready)
+				case "subsystem": // used by sftp and scp
+					var sub struct{ Name string }
+					ssh.Unmarshal(req.Payload, &sub)
+					if sub.Name != "sftp" || ss.Files == "" {
+						fmt.Fprintf(os.Stderr, "[ssh: unsupported subsystem: %q]\n", sub.Name)
+						req.Reply(false, nil)
+						channel.Close()
+						return
+					}
+					fmt.Fprintf(os.Stderr, "[ssh: sftp]\n")
+					req.Reply(true, nil)
+					mode = sftpMode
+					close(ready)
+				case "pty-req": // interactive session, we do the line editing
+					var pty struct {
+						Term                 string
+						Cols, Rows, Wpx, Hpx uint32
+						Modes                string
+					}
+					if err := ssh.Unmarshal(req.Payload, &pty); err != nil {
+						req.Reply(false, nil)
+						continue
+					}
+					// Ctrl-c is taken out before it gets to the terminal, which would
+					// treat it as end of input.
+					in := &interruptReader{r: channel, onInterrupt: func() { interrupt(tty) }}
+					tty = term.NewTerminal(struct {
+						io.Reader
+						io.Writer
+					}{in, channel}, "")
+					tty.SetSize(int(pty.Cols), int(pty.Rows))
+					req.Reply(true, nil)
+				case "window-change":
+					var size struct{ Cols, Rows, Wpx, Hpx uint32 }
+					if err := ssh.Unmarshal(req.Payload, &size); err == nil && tty != nil {
+						tty.SetSize(int(size.Cols), int(size.Rows))
+					}
+					req.Reply(true, nil)
+				case "signal": // only INT is supported, it resets the microcontroller
+					var sig struct{ Name string }
+					ssh.Unmarshal(req.Payload, &sig)
+					if sig.Name == string(ssh.SIGINT) {
+						var w io.Writer = channel
+						if tty != nil {
+							w = tty
+						}
+						go interrupt(w)
+					}
+					req.Reply(sig.Name == string(ssh.SIGINT), nil)
 				case "env": // used by std SSH client, just ignore
 					req.Reply(true, nil)
 				default:
@@ -186,17 +283,54 @@ func (ss *SSHServer) service(conn net.Conn, rx chan<- NetInput) { //, cmd chan s
 		go func() {
 			defer channel.Close()
 			<-ready // wait for shell/exec request
+			// Register with switchboard so it can TX data.
+			switch {
+			case mode == sftpMode, mode == listMode:
+			case mode == RawIn && tty != nil:
+				b.SW.AddConsoleOutput(tty)
+			default:
+				b.SW.AddConsoleOutput(channel)
+			}
 			// We operate in two distinct modes: for RawIn we forward bytes as they come
 			// in but for other modes we read the full input into a buffer and forward
 			// it at once.
 			switch mode {
 			case RawIn:
+				if tty != nil {
+					// Interactive session, send line by line so ! commands work. Keep
+					// reading while a command runs, so ctrl-c can interrupt it.
+					lines := make(chan string)
+					go func() {
+						defer close(lines)
+						for {
+							line, err := tty.ReadLine()
+							if err != nil {
+								return
+							}
+							lines <- line
+						}
+					}()
+					for line := range lines {
+						done := make(chan struct{})
+						b.Input <- NetInput{What: CommandIn, Buf: []byte(line + "\n"), From: from,
+							Reply: tty, Done: done, Role: role}
+						<-done
+					}
+					return
+				}
+				if role < requiredRole(RawIn) {
+					// Observers only get to see the output, drain and ignore any input.
+					fmt.Fprintf(channel, "[read-only, %s role]\r\n", role)
+					io.Copy(ioutil.Discard, channel)
+					return
+				}
 				for {
 					// Read data from SSH channel
 					buf := getBuffer()
 					n, err := channel.Read(buf)
 					if n > 0 {
-						rx <- NetInput{What: mode, Buf: buf[:n]}
+						b.Input <- NetInput{What: mode, Buf: buf[:n], From: from,
+							Reply: channel, Role: role}
 						continue
 					}
 					if err != nil {
@@ -204,15 +338,78 @@ func (ss *SSHServer) service(conn net.Conn, rx chan<- NetInput) { //, cmd chan s
 						return
 					}
 				}
-			case ResetIn:
-				rx <- NetInput{What: mode}
+			case ResetIn, LockIn, UnlockIn:
+				var err error
+				done := make(chan struct{})
+				b.Input <- NetInput{What: mode, From: from, Reply: channel, Done: done,
+					Err: &err, Role: role}
+				<-done
+				exitStatus(channel, err)
 			case ForthIn, PacketIn, FlashIn:
-				buf, _ := ioutil.ReadAll(channel)
-				rx <- NetInput{What: mode, Buf: buf}
+				var buf []byte
+				var err error
+				if file != "" && mode == ForthIn {
+					buf, err = readForth(ss.Files, file)
+				} else if file != "" {
+					buf, err = readFile(ss.Files, file)
+				} else {
+					buf, err = ioutil.ReadAll(channel)
+				}
+				if err != nil {
+					fmt.Fprintf(channel.Stderr(), "%s\n", err)
+					exitStatus(channel, err)
+					return
+				}
+				done := make(chan struct{})
+				b.Input <- NetInput{What: mode, Buf: buf, From: from, Reply: channel, Done: done,
+					Err: &err, Role: role}
+				<-done
+				exitStatus(channel, err)
+			case listMode:
+				ss.boards.List(channel)
+				exitStatus(channel, nil)
+			case sftpMode:
+				if err := serveSFTP(channel, ss.Files, role < RoleAdmin); err != nil {
+					fmt.Fprintf(os.Stderr, "[ssh: sftp: %s]\n", err)
+				}
 			}
 		}()
 
-		// Register with switchboard so it can TX data.
-		ss.addTxWriter(channel)
 	}
+
+	// The connection is gone, make sure it doesn't keep holding the lock on any of the boards.
+	for _, b := range ss.boards {
+		b.Input <- NetInput{What: UnlockIn, From: from}
+	}
+}
+
+// exitStatus tells the client how a command went, it's the exit status of "ssh folie flash" and
+// the like, and it's how a local folie connected via SSH learns that a command failed.
+func exitStatus(channel ssh.Channel, err error) {
+	var status struct{ Status uint32 }
+	if err != nil {
+		status.Status = 1
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+}
+
+// interruptReader passes data through, except for ctrl-c characters, for which it calls
+// onInterrupt instead.
+type interruptReader struct {
+	r           io.Reader
+	onInterrupt func()
+}
+
+func (ir *interruptReader) Read(buf []byte) (int, error) {
+	n, err := ir.r.Read(buf)
+	j := 0
+	for _, b := range buf[:n] {
+		if b == 3 {
+			ir.onInterrupt()
+		} else {
+			buf[j] = b
+			j++
+		}
+	}
+	return j, err
 }
@@ -0,0 +1,106 @@
+package folie
+
+// This file contains a reader for the subset of ~/.ssh/config used by the SSH client.
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sshHostConfig holds the settings from ~/.ssh/config which apply to a host.
+type sshHostConfig struct {
+	HostName      string
+	Port          string
+	User          string
+	IdentityFiles []string
+}
+
+// readSSHConfig returns the settings of the Host sections in an ssh config file which match host.
+// As with OpenSSH, the first value found for a setting wins, except that all identity files are
+// collected. Match sections and all other settings are ignored. A missing file is not an error.
+func readSSHConfig(file, host string) (sshHostConfig, error) {
+	var hc sshHostConfig
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hc, nil
+		}
+		return hc, err
+	}
+	defer f.Close()
+
+	matching := true // settings before the first Host line apply to all hosts
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// A keyword is separated from its arguments by whitespace and/or an equal sign.
+		keyword := line
+		args := ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			keyword = line[:i]
+			args = strings.TrimLeft(line[i:], " \t=")
+			args = strings.Trim(args, `"`)
+		}
+
+		switch strings.ToLower(keyword) {
+		case "host":
+			matching = matchHostPatterns(strings.Fields(args), host)
+		case "match":
+			matching = false
+		case "hostname":
+			if matching && hc.HostName == "" {
+				hc.HostName = args
+			}
+		case "port":
+			if matching && hc.Port == "" {
+				hc.Port = args
+			}
+		case "user":
+			if matching && hc.User == "" {
+				hc.User = args
+			}
+		case "identityfile":
+			if matching {
+				hc.IdentityFiles = append(hc.IdentityFiles, args)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return hc, err
+	}
+
+	// Expand the tokens which make sense for identity files.
+	realHost := host
+	if hc.HostName != "" {
+		realHost = hc.HostName
+	}
+	for i, f := range hc.IdentityFiles {
+		f = strings.Replace(f, "%d", os.Getenv("HOME"), -1)
+		f = strings.Replace(f, "%h", realHost, -1)
+		f = strings.Replace(f, "%%", "%", -1)
+		hc.IdentityFiles[i] = ExpandHome(f)
+	}
+	return hc, nil
+}
+
+// matchHostPatterns returns true if host matches one of the patterns of a Host line and none of
+// the negated ones.
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pat := range patterns {
+		negated := strings.HasPrefix(pat, "!")
+		if ok, _ := filepath.Match(strings.TrimPrefix(pat, "!"), host); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
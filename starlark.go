@@ -0,0 +1,544 @@
+package folie
+
+// This file contains the Starlark scripting, for automation which needs more logic than the
+// scripts of !run, such as parsing sensor values, deciding when to reflash, or driving several
+// boards at once.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// StarlarkHost runs Starlark scripts in the background. Scripts control the boards through their
+// switchboards like any other client, so they're subject to the lock and to the role of whoever
+// started them. Starlark has no access to the network and include and upload can only read files
+// inside the Files directory, but besides its built-ins, scripts can use:
+//
+//	board([name])            returns the named board, or the one the script was started on
+//	boards()                 returns the names of all the boards
+//	send, write, reset,      same as the methods of board(), see below
+//	  include, upload
+//	expect(re, [timeout])    same as expect of a subscription made when the script started
+//	sleep(seconds)           waits
+//	time()                   returns the current time in seconds since the epoch
+//	print(msg)               shows a message on the consoles of the board
+//
+// Boards have a name attribute and these methods:
+//
+//	send(text)     sends text followed by a carriage return
+//	write(text)    sends text as is
+//	reset()        resets the microcontroller
+//	include(file)  sends a forth source file, expanding its include lines
+//	upload(file)   uploads firmware (bin, hex, or elf format), then resets
+//	state()        describes the connection and the lock, as listed by "ssh folie list"
+//	subscribe()    returns a subscription to the output of the microcontroller
+//
+// Subscriptions have these methods:
+//
+//	read([timeout])        returns the output received since the previous read or expect, or
+//	                       None if nothing arrives within timeout
+//	expect(re, [timeout])  waits for output matching re and returns a list with the match and
+//	                       its submatches, or None on timeout, the output up to the match is
+//	                       consumed
+//	close()                stops receiving
+//
+// Timeouts are in seconds, the default is DefaultExpectTimeout. Errors, such as a failed upload,
+// a board locked by someone else, or calling fail(), stop the script.
+type StarlarkHost struct {
+	Boards Boards // the boards scripts can control
+	Files  string // directory with the files scripts can include and upload, "" for the current one
+
+	mu      sync.Mutex              // protect fields below
+	running map[int]*starlarkScript // scripts by id
+	lastID  int                     // id of the most recently started script
+}
+
+// scriptOptions relaxes the Starlark dialect, which is meant for configuration files, to be
+// more like Python, since scripts are programs which poll and wait in loops.
+var scriptOptions = &syntax.FileOptions{Set: true, While: true, TopLevelControl: true,
+	GlobalReassign: true, Recursion: true}
+
+// starlarkScript is a running script.
+type starlarkScript struct {
+	id      int
+	name    string           // file name
+	host    *StarlarkHost    // where the script runs
+	src     string           // identifies the script as source of input to the switchboards
+	board   *Board           // the board the script was started on, board() returns it
+	role    Role             // what the script is permitted to do
+	started time.Time        // when the script was started
+	thread  *starlark.Thread // Starlark's state of the script
+	stop    chan struct{}    // closed to stop the script
+	subs    []*Subscription  // to be closed when the script ends
+}
+
+// Start runs a script in the background, with b as its default board and with the permissions
+// of role. It returns the id of the script, for Stop. Messages go to the consoles of the board.
+func (h *StarlarkHost) Start(name string, b *Board, role Role) int {
+	h.mu.Lock()
+	if h.running == nil {
+		h.running = map[int]*starlarkScript{}
+	}
+	h.lastID++
+	s := &starlarkScript{id: h.lastID, name: name, host: h, src: "script:" + filepath.Base(name),
+		board: b, role: role, started: time.Now(), stop: make(chan struct{})}
+	s.thread = &starlark.Thread{Name: s.src, Print: func(_ *starlark.Thread, msg string) {
+		s.log("%s", msg)
+	}}
+	h.running[s.id] = s
+	h.mu.Unlock()
+
+	go func() {
+		s.run()
+		h.mu.Lock()
+		delete(h.running, s.id)
+		h.mu.Unlock()
+	}()
+	return s.id
+}
+
+// Stop stops the script with the specified id, it returns false if there is no such script.
+func (h *StarlarkHost) Stop(id int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.running[id]
+	if s == nil {
+		return false
+	}
+	close(s.stop)
+	s.thread.Cancel("stopped")
+	delete(h.running, id)
+	return true
+}
+
+// List writes a line for each running script.
+func (h *StarlarkHost) List(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.running) == 0 {
+		fmt.Fprintln(w, "No scripts running.")
+		return
+	}
+	var ids []int
+	for id := range h.running {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s := h.running[id]
+		fmt.Fprintf(w, "%3d %-24s %-16s running for %s\n", id, s.name, s.board.Name,
+			time.Since(s.started).Round(time.Second))
+	}
+}
+
+// root returns the directory with the files scripts can access.
+func (h *StarlarkHost) root() string {
+	if h.Files == "" {
+		return "."
+	}
+	return h.Files
+}
+
+// path returns the path of a file a script refers to, which must be inside the root directory.
+func (h *StarlarkHost) path(name string) (string, error) {
+	return rootedPath(h.root(), h.root(), name)
+}
+
+// run executes the script and reports how it went.
+func (s *starlarkScript) run() {
+	s.log("started, \"!script stop %d\" stops it", s.id)
+	defer func() {
+		for _, sub := range s.subs {
+			sub.Close()
+		}
+	}()
+
+	_, err := starlark.ExecFileOptions(scriptOptions, s.thread, s.name, nil, s.builtins())
+	select {
+	case <-s.stop:
+		s.log("stopped")
+		return
+	default:
+	}
+	if e, ok := err.(*starlark.EvalError); ok {
+		s.log("failed: %s", e.Backtrace())
+	} else if err != nil {
+		s.log("failed: %s", err)
+	} else {
+		s.log("done")
+	}
+}
+
+// log shows a message on the consoles of the script's board and reports it to the taps.
+func (s *starlarkScript) log(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	s.board.SW.tap(Event, s.src, []byte(msg))
+	notify(&consoleWriter{s.board.SW}, "%s: %s", s.src, msg)
+}
+
+// builtins returns the functions scripts can use in addition to Starlark's own.
+func (s *starlarkScript) builtins() starlark.StringDict {
+	d := starlark.StringDict{
+		"board":  starlark.NewBuiltin("board", s.boardFn),
+		"boards": starlark.NewBuiltin("boards", s.boardsFn),
+		"sleep":  starlark.NewBuiltin("sleep", s.sleepFn),
+		"time":   starlark.NewBuiltin("time", s.timeFn),
+	}
+	def := &starlarkBoard{s, s.board}
+	for _, name := range []string{"send", "write", "reset", "include", "upload"} {
+		d[name], _ = def.Attr(name)
+	}
+	d["expect"], _ = s.subscribe(s.board).Attr("expect")
+	return d
+}
+
+// input sends input to a board through its switchboard, and waits until it has been processed.
+func (s *starlarkScript) input(b *Board, what int, buf []byte) error {
+	var err error
+	done := make(chan struct{})
+	select {
+	case b.Input <- NetInput{What: what, Buf: buf, From: s.src, Reply: &consoleWriter{b.SW},
+		Done: done, Err: &err, Role: s.role}:
+	case <-s.stop:
+		return fmt.Errorf("stopped")
+	}
+	<-done
+	return err
+}
+
+// subscribe subscribes to the output of a board until the script ends.
+func (s *starlarkScript) subscribe(b *Board) *starlarkSub {
+	sub := b.SW.Subscribe()
+	s.subs = append(s.subs, sub)
+	return &starlarkSub{s: s, b: b, sub: sub}
+}
+
+// wait waits for d, or until the script is stopped.
+func (s *starlarkScript) wait(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-s.stop:
+	}
+}
+
+func (s *starlarkScript) boardFn(thread *starlark.Thread, fn *starlark.Builtin,
+	args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	name := ""
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name?", &name); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return &starlarkBoard{s, s.board}, nil
+	}
+	if b := s.host.Boards.Find(name); b != nil {
+		return &starlarkBoard{s, b}, nil
+	}
+	return nil, fmt.Errorf("%s: no such board: %s", fn.Name(), name)
+}
+
+func (s *starlarkScript) boardsFn(thread *starlark.Thread, fn *starlark.Builtin,
+	args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	var names []starlark.Value
+	for _, b := range s.host.Boards {
+		names = append(names, starlark.String(b.Name))
+	}
+	return starlark.NewList(names), nil
+}
+
+func (s *starlarkScript) sleepFn(thread *starlark.Thread, fn *starlark.Builtin,
+	args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var seconds starlark.Value
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "seconds", &seconds); err != nil {
+		return nil, err
+	}
+	d, err := starlarkDuration(fn.Name(), seconds)
+	if err != nil {
+		return nil, err
+	}
+	s.wait(d)
+	return starlark.None, nil
+}
+
+func (s *starlarkScript) timeFn(thread *starlark.Thread, fn *starlark.Builtin,
+	args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return starlark.Float(float64(time.Now().UnixNano()) / 1e9), nil
+}
+
+// starlarkDuration converts a number of seconds, as int or float, to a duration.
+func starlarkDuration(fn string, v starlark.Value) (time.Duration, error) {
+	f, ok := starlark.AsFloat(v)
+	if !ok || f < 0 {
+		return 0, fmt.Errorf("%s: want a non-negative number of seconds, got %s", fn, v)
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// starlarkTimeout unpacks the arguments of functions with an optional timeout, which follows
+// the regexp if re is not nil.
+func starlarkTimeout(fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple,
+	re *string) (time.Duration, error) {
+	var timeout starlark.Value = starlark.Float(DefaultExpectTimeout.Seconds())
+	var err error
+	if re != nil {
+		err = starlark.UnpackArgs(fn.Name(), args, kwargs, "re", re, "timeout?", &timeout)
+	} else {
+		err = starlark.UnpackArgs(fn.Name(), args, kwargs, "timeout?", &timeout)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return starlarkDuration(fn.Name(), timeout)
+}
+
+// starlarkMethods maps the names of methods to their implementation, for values with methods.
+type starlarkMethods map[string]func(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error)
+
+// attr returns the named method, bound to recv, or nil if there is none.
+func (ms starlarkMethods) attr(recv starlark.Value, name string) starlark.Value {
+	m := ms[name]
+	if m == nil {
+		return nil
+	}
+	return starlark.NewBuiltin(name, func(thread *starlark.Thread, fn *starlark.Builtin,
+		args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return m(fn, args, kwargs)
+	}).BindReceiver(recv)
+}
+
+// names returns the sorted names of the methods.
+func (ms starlarkMethods) names() []string {
+	var names []string
+	for name := range ms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// starlarkBoard is the Starlark value representing a board.
+type starlarkBoard struct {
+	s *starlarkScript
+	b *Board
+}
+
+func (sb *starlarkBoard) String() string        { return fmt.Sprintf("<board %s>", sb.b.Name) }
+func (sb *starlarkBoard) Type() string          { return "board" }
+func (sb *starlarkBoard) Freeze()               {}
+func (sb *starlarkBoard) Truth() starlark.Bool  { return starlark.True }
+func (sb *starlarkBoard) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: board") }
+
+func (sb *starlarkBoard) methods() starlarkMethods {
+	return starlarkMethods{
+		"send":      sb.send,
+		"write":     sb.write,
+		"reset":     sb.reset,
+		"include":   sb.include,
+		"upload":    sb.upload,
+		"state":     sb.state,
+		"subscribe": sb.subscribe,
+	}
+}
+
+func (sb *starlarkBoard) Attr(name string) (starlark.Value, error) {
+	if name == "name" {
+		return starlark.String(sb.b.Name), nil
+	}
+	return sb.methods().attr(sb, name), nil
+}
+
+func (sb *starlarkBoard) AttrNames() []string {
+	return append(sb.methods().names(), "name")
+}
+
+func (sb *starlarkBoard) send(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	var text string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "text", &text); err != nil {
+		return nil, err
+	}
+	return starlark.None, sb.s.input(sb.b, RawIn, []byte(text+"\r"))
+}
+
+func (sb *starlarkBoard) write(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	var text string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "text", &text); err != nil {
+		return nil, err
+	}
+	return starlark.None, sb.s.input(sb.b, RawIn, []byte(text))
+}
+
+func (sb *starlarkBoard) reset(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return starlark.None, sb.s.input(sb.b, ResetIn, nil)
+}
+
+func (sb *starlarkBoard) include(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	var file string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "file", &file); err != nil {
+		return nil, err
+	}
+	name, err := sb.s.host.path(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	var code bytes.Buffer
+	in := &Includer{Tx: &code, DryRun: true, Root: sb.s.host.root()}
+	if !in.Include(name) {
+		return nil, fmt.Errorf("expanding %s failed", file)
+	}
+	return starlark.None, sb.s.input(sb.b, ForthIn, code.Bytes())
+}
+
+func (sb *starlarkBoard) upload(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	var file string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "file", &file); err != nil {
+		return nil, err
+	}
+	name, err := sb.s.host.path(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, sb.s.input(sb.b, FlashIn, data)
+}
+
+func (sb *starlarkBoard) state(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return starlark.String(sb.b.State()), nil
+}
+
+func (sb *starlarkBoard) subscribe(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return sb.s.subscribe(sb.b), nil
+}
+
+// starlarkSub is the Starlark value representing a subscription to the output of a board.
+type starlarkSub struct {
+	s        *starlarkScript
+	b        *Board
+	sub      *Subscription
+	received outputBuffer // output not yet consumed by read or expect
+}
+
+func (ss *starlarkSub) String() string        { return fmt.Sprintf("<subscription %s>", ss.b.Name) }
+func (ss *starlarkSub) Type() string          { return "subscription" }
+func (ss *starlarkSub) Freeze()               {}
+func (ss *starlarkSub) Truth() starlark.Bool  { return starlark.True }
+func (ss *starlarkSub) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: subscription") }
+
+func (ss *starlarkSub) methods() starlarkMethods {
+	return starlarkMethods{
+		"read":   ss.read,
+		"expect": ss.expect,
+		"close":  ss.close,
+	}
+}
+
+func (ss *starlarkSub) Attr(name string) (starlark.Value, error) {
+	return ss.methods().attr(ss, name), nil
+}
+
+func (ss *starlarkSub) AttrNames() []string {
+	return ss.methods().names()
+}
+
+func (ss *starlarkSub) read(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	timeout, err := starlarkTimeout(fn, args, kwargs, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(ss.received.data) == 0 && !ss.receive(time.Now().Add(timeout)) {
+		return starlark.None, nil
+	}
+	return starlark.String(ss.received.take()), nil
+}
+
+func (ss *starlarkSub) expect(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern string
+	timeout, err := starlarkTimeout(fn, args, kwargs, &pattern)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	deadline := time.Now().Add(timeout)
+	match := ss.received.expect(re, func() bool { return ss.receive(deadline) })
+	if match == nil {
+		return starlark.None, nil
+	}
+	values := make([]starlark.Value, len(match))
+	for i, m := range match {
+		values[i] = starlark.None
+		if m != nil {
+			values[i] = starlark.String(m)
+		}
+	}
+	return starlark.NewList(values), nil
+}
+
+func (ss *starlarkSub) close(fn *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	ss.sub.Close()
+	return starlark.None, nil
+}
+
+// receive waits for output until the deadline and adds it to what has been received. It returns
+// false if nothing arrived in time, or if the script was stopped.
+func (ss *starlarkSub) receive(deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		if buf := ss.sub.Take(); buf != nil {
+			ss.received.add(buf)
+			return true
+		}
+		select {
+		case <-ss.sub.Ready():
+		case <-timer.C:
+			return false
+		case <-ss.s.stop:
+			return false
+		}
+	}
+}
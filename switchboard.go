@@ -23,32 +23,223 @@ func putBuffer(b []byte) {
 
 // NetInput can hold a byte buffer or a command.
 type NetInput struct {
-	What int    // one of RawIn, PacketIn, CommandIn, FlashIn
-	Buf  []byte // data
+	What  int           // one of RawIn, PacketIn, CommandIn, FlashIn
+	Buf   []byte        // data
+	From  string        // who sent it, e.g. "ssh:user@host:port"
+	Reply io.Writer     // where to send notices meant only for the sender, may be nil
+	Done  chan struct{} // if not nil, closed once the input has been processed
+	Err   *error        // if not nil, set to the reason processing failed before Done is closed
+	Role  Role          // what the sender is permitted to do
 }
 
 const (
-	RawIn    = iota // raw bytes input
-	ResetIn         // reset uC (has no data)
-	PacketIn        // data packet (data is packet)
-	ForthIn         // forth source code (data is code, no echo desired)
-	FlashIn         // flash upload (data is flash binary/hex)
+	RawIn     = iota // raw bytes input
+	ResetIn          // reset uC (has no data)
+	PacketIn         // data packet (data is packet)
+	ForthIn          // forth source code (data is code, no echo desired)
+	FlashIn          // flash upload (data is flash binary/hex)
+	LockIn           // take the exclusive lock (has no data)
+	UnlockIn         // release the exclusive lock, e.g. on disconnect (has no data)
+	CommandIn        // line from a remote interactive console (data may be a ! command)
 )
 
 // Switchboard represents the central point where all input and output methods come together. This
 // where data is forwarded from one to another and where the decision is made whether to interpret
 // commands or pass data through uninterpreted.
 type Switchboard struct {
-	MicroInput   <-chan []byte   // receive from microcontroller
-	MicroOutput  MicroConn       // send to microcontroller
-	ConsoleInput <-chan []byte   // receive from interactive console (has ! commands)
-	NetworkInput <-chan NetInput // receive from remote consoles (no ! commands)
+	MicroInput   <-chan []byte    // receive from microcontroller, tapped by NewSwitchboard
+	MicroOutput  MicroConn        // send to microcontroller
+	ConsoleInput <-chan []byte    // receive from interactive console (has ! commands)
+	NetworkInput <-chan NetInput  // receive from remote consoles (no ! commands)
+	ConnEvents   <-chan ConnEvent // changes of the connection to the microcontroller
 
 	AssetNames []string                     // list of built-in firmwares
 	Asset      func(string) ([]byte, error) // callback to get asset
+	Firmware   string                       // default firmware for "!u 0", file name or URL
+	Hooks      Hooks                        // what to do when something happens, see Reconfigure
+	Scripts    *StarlarkHost                // runs the scripts of !script, nil if not available
+	Macros     map[string][]string          // user-defined ! commands, by name without the !
 
-	mu            sync.Mutex  // protect fields below
-	consoleOutput []io.Writer // broadcast to multiple consoles
+	mu            sync.Mutex    // protect fields below
+	consoleOutput []io.Writer   // broadcast to multiple consoles
+	taps          []Tap         // get a copy of all traffic
+	lockedBy      string        // client holding the exclusive lock, if any
+	connState     ConnState     // last state reported on ConnEvents
+	hooks         []pendingHook // hooks waiting to run, see queueHook
+
+	untapped   <-chan []byte // original MicroInput, see NewSwitchboard
+	tapped     chan<- []byte // feeds MicroInput, see tapMicroInput
+	jobs       chan func()   // work queued by other goroutines to run inside Run
+	watch      *watcher      // active !watch, only used inside Run
+	transcript *Transcript   // active session log, see OpenLog
+	inHook     bool          // running a hook, only used inside Run
+	holds      int           // nesting depth of hold, only used inside Run
+	lastSend   string        // file most recently sent using !send, only used inside Run
+	macroDepth int           // how many macros are running, only used inside Run
+}
+
+// NewSwitchboard finishes setting up a switchboard whose exported fields have been filled in. It
+// replaces MicroInput by a channel which gets the data once the taps have seen it, so this must be
+// done before anything gets to read MicroInput. The data starts flowing when Run is called.
+func NewSwitchboard(sw *Switchboard) *Switchboard {
+	tapped := make(chan []byte, 1)
+	sw.untapped, sw.tapped = sw.MicroInput, tapped
+	sw.MicroInput = tapped
+	sw.jobs = make(chan func(), 1)
+	return sw
+}
+
+// Directions of the traffic reported to taps.
+const (
+	FromMicro = '<' // data received from the microcontroller
+	ToMicro   = '>' // data sent to the microcontroller
+	Event     = '*' // something else happened, such as a reset
+)
+
+// Tap receives a copy of all the traffic passing through the switchboard. For data sent to the
+// microcontroller, src tells where it came from, e.g. "console" or "ssh:user@host:port". Tap
+// must not block and must not hold on to buf.
+type Tap interface {
+	Tap(dir byte, src string, buf []byte)
+}
+
+// AddTap registers a new tap to get a copy of all traffic.
+func (sw *Switchboard) AddTap(t Tap) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.taps = append(sw.taps, t)
+}
+
+// RemoveTap unregisters a tap.
+func (sw *Switchboard) RemoveTap(t Tap) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	for i := 0; i < len(sw.taps); i++ {
+		if sw.taps[i] == t {
+			sw.taps = append(sw.taps[:i], sw.taps[i+1:]...)
+		}
+	}
+}
+
+// Subscription receives a copy of the output of the microcontroller, which still goes to the
+// consoles as usual, e.g. for scripts watching a board. Output is kept until taken, but only the
+// most recent part if the subscriber falls behind.
+type Subscription struct {
+	sw    *Switchboard
+	mu    sync.Mutex    // protect buf
+	buf   []byte        // output not yet taken
+	ready chan struct{} // signalled when output is added to buf
+}
+
+// Subscribe starts a subscription to the output of the microcontroller, it must be closed once
+// no longer needed.
+func (sw *Switchboard) Subscribe() *Subscription {
+	s := &Subscription{sw: sw, ready: make(chan struct{}, 1)}
+	sw.AddTap(s)
+	return s
+}
+
+// Tap implements the Tap interface to collect the output.
+func (s *Subscription) Tap(dir byte, src string, buf []byte) {
+	if dir != FromMicro {
+		return
+	}
+	s.mu.Lock()
+	s.buf = append(s.buf, buf...)
+	if len(s.buf) > maxReceived {
+		s.buf = append([]byte(nil), s.buf[len(s.buf)-maxReceived:]...)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready returns a channel which receives a value when output is available to Take.
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Take returns the output received since the previous Take, or nil if there is none.
+func (s *Subscription) Take() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := s.buf
+	s.buf = nil
+	return buf
+}
+
+// Read waits up to timeout for output and returns it, or nil if there is none.
+func (s *Subscription) Read(timeout time.Duration) []byte {
+	deadline := time.After(timeout)
+	for {
+		if buf := s.Take(); buf != nil {
+			return buf
+		}
+		select {
+		case <-s.ready:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.sw.RemoveTap(s)
+}
+
+// tap passes traffic on to all registered taps.
+func (sw *Switchboard) tap(dir byte, src string, buf []byte) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	for _, t := range sw.taps {
+		t.Tap(dir, src, buf)
+	}
+}
+
+// tappedConn is a MicroConn which reports all writes and resets to the taps of its switchboard.
+type tappedConn struct {
+	MicroConn
+	sw  *Switchboard
+	src string
+}
+
+func (tc tappedConn) Write(buf []byte) (int, error) {
+	tc.sw.tap(ToMicro, tc.src, buf)
+	return tc.MicroConn.Write(buf)
+}
+
+func (tc tappedConn) Reset(enterBoot bool) bool {
+	tc.sw.tap(Event, tc.src, []byte("reset"))
+	ok := tc.MicroConn.Reset(enterBoot)
+	if ok && !enterBoot {
+		tc.sw.afterReset()
+	}
+	return ok
+}
+
+// to returns the connection to the microcontroller to use for sending data from src.
+func (sw *Switchboard) to(src string) MicroConn {
+	return tappedConn{sw.MicroOutput, sw, src}
+}
+
+// tapMicroInput reports everything received from the microcontroller to the taps, before it is
+// passed on to the code reading MicroInput. It runs in its own goroutine, started by Run.
+func (sw *Switchboard) tapMicroInput() {
+	var recent []byte
+	for buf := range sw.untapped {
+		sw.tap(FromMicro, "micro", buf)
+		recent = sw.watchBanner(recent, buf)
+		sw.tapped <- buf
+	}
+	close(sw.tapped)
 }
 
 // AddConsoleOutput registers a new writer to get console output.
@@ -106,8 +297,14 @@ func (cw *consoleWriter) Write(buf []byte) (int, error) {
 // switchboard until it's done. This is helpful when running commands (like flashing the uC) that
 // should not be interrupted by other stuff.
 func (sw *Switchboard) Run() {
+	go sw.tapMicroInput()
+	sw.queueHook("connect", sw.Hooks.Connect)
 	for {
 		select {
+		// Work queued up by goroutines which need exclusive access to the microcontroller.
+		case job := <-sw.jobs:
+			job()
+
 		// Input from the microcontroller.
 		case buf := <-sw.MicroInput:
 			if Verbose {
@@ -116,62 +313,159 @@ func (sw *Switchboard) Run() {
 			sw.consoleWrite(buf)
 			putBuffer(buf)
 
+		// The connection to the microcontroller went down or came back up.
+		case ev := <-sw.ConnEvents:
+			sw.connEvent(ev)
+
 		// Input from the interactive console, interpret ! commands.
 		case buf := <-sw.ConsoleInput:
-			if buf[0] == '!' {
-				// Convert buf to string.
-				var line string
-				if buf[len(buf)-1] == '\n' {
-					line = string(buf[:len(buf)-1])
-				} else {
-					line = string(buf)
-				}
-				// See if it's a special command.
-				if sw.specialCommand(line) {
-					continue
-				}
-				// Else, treat as normal.
-			}
-			if Verbose {
-				fmt.Printf("send: %q\n", buf)
-			}
-			sw.MicroOutput.Write(buf)
-			putBuffer(buf)
+			sw.consoleInput(buf)
 
 		// Input from the network, it has several possible commands "baked-in"
 		case inp := <-sw.NetworkInput:
-			switch inp.What {
-			case RawIn: // console input, forward as-is
-				if Verbose {
-					fmt.Printf("send: %q\n", inp.Buf)
-				}
-				sw.MicroOutput.Write(inp.Buf)
-			case ResetIn: // just cause a reset
-				sw.MicroOutput.Reset(false)
-			case FlashIn: // reflash/upload microcontroller
-				up := Uploader{Tx: sw.MicroOutput, Rx: sw.MicroInput,
-					Stdout: &consoleWriter{sw}}
-				up.Upload(inp.Buf)
-				time.Sleep(time.Second)
-				sw.MicroOutput.Reset(false)
-			case PacketIn:
-				line := encodePacket(inp.Buf)
-				sw.MicroOutput.Write(append(line, []byte(".v\n")...))
-			case ForthIn: // send forth source block to uC with flow-control and no echo
-				// We need to feed line-by-line to the output 'cause we need
-				// to read input, match it, and thereby rate-limit.
-				for _, line := range bytes.Split(inp.Buf, []byte{'\n'}) {
-					sw.MicroOutput.Write(line)
-					sw.MicroOutput.Write([]byte{'\n'})
-					if !match(string(line), sw.MicroInput) {
-						break
-					}
-				}
+			sw.networkInput(inp)
+		}
+	}
+}
+
+// connEvent tells everyone about a change of the connection to the microcontroller.
+func (sw *Switchboard) connEvent(ev ConnEvent) {
+	sw.mu.Lock()
+	sw.connState = ev.State
+	sw.mu.Unlock()
+
+	sw.tap(Event, "micro", []byte(ev.String()))
+	sw.consoleWrite([]byte(fmt.Sprintf("\n[%s]\n", ev)))
+	if ev.State == Connected {
+		sw.queueHook("connect", sw.Hooks.Connect)
+	}
+}
+
+// ConnState returns the state of the connection to the microcontroller.
+func (sw *Switchboard) ConnState() ConnState {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return sw.connState
+}
+
+// consoleInput processes one line of input from the interactive console.
+func (sw *Switchboard) consoleInput(buf []byte) {
+	sw.lineInput(buf, localClient())
+}
+
+// lineInput processes one line of input from an interactive console, which is either a !
+// command or gets sent to the microcontroller.
+func (sw *Switchboard) lineInput(buf []byte, c *cmdClient) {
+	if buf[0] == '!' {
+		// Convert buf to string.
+		var line string
+		if buf[len(buf)-1] == '\n' {
+			line = string(buf[:len(buf)-1])
+		} else {
+			line = string(buf)
+		}
+		// See if it's a special command.
+		if sw.specialCommand(line, c) {
+			return
+		}
+		// Else, treat as normal.
+	}
+	if need := requiredRole(RawIn); c.Role < need {
+		notify(c.reply(), "permission denied, %s role required", need)
+		return
+	}
+	if !sw.allowed(c.Src, c.reply()) {
+		return
+	}
+	if Verbose {
+		fmt.Printf("send: %q\n", buf)
+	}
+	sw.to(c.Src).Write(buf)
+	putBuffer(buf)
+}
+
+// networkInput processes one input from a remote client.
+func (sw *Switchboard) networkInput(inp NetInput) {
+	var err error
+	defer func() {
+		if inp.Err != nil {
+			*inp.Err = err
+		}
+		if inp.Done != nil {
+			close(inp.Done)
+		}
+	}()
+	if need := requiredRole(inp.What); inp.Role < need {
+		notify(inp.Reply, "permission denied, %s role required", need)
+		err = fmt.Errorf("permission denied, %s role required", need)
+		return
+	}
+	switch inp.What {
+	case LockIn:
+		sw.lock(inp.From, inp.Reply)
+		return
+	case UnlockIn:
+		sw.unlock(inp.From, inp.Reply)
+		return
+	case CommandIn: // same as a line from the local console, checks the lock itself
+		sw.lineInput(inp.Buf, &cmdClient{Src: inp.From, Out: inp.Reply, Role: inp.Role})
+		return
+	}
+	if !sw.allowed(inp.From, inp.Reply) {
+		err = fmt.Errorf("locked by %s", sw.owner())
+		return
+	}
+
+	tx := sw.to(inp.From)
+	switch inp.What {
+	case RawIn: // console input, forward as-is
+		if Verbose {
+			fmt.Printf("send: %q\n", inp.Buf)
+		}
+		tx.Write(inp.Buf)
+	case ResetIn: // just cause a reset
+		tx.Reset(false)
+	case FlashIn: // reflash/upload microcontroller
+		release := sw.hold(inp.From, "flash upload")
+		sw.tap(Event, inp.From, []byte(fmt.Sprintf("flash %d bytes", len(inp.Buf))))
+		up := Uploader{Tx: sw.MicroOutput, Rx: sw.MicroInput,
+			Stdout: &consoleWriter{sw}}
+		up.Upload(inp.Buf)
+		if up.Failed {
+			err = fmt.Errorf("flash upload failed")
+		}
+		time.Sleep(time.Second)
+		tx.Reset(false)
+		if !up.Failed {
+			sw.queueHook("upload", sw.Hooks.Upload)
+		}
+		release()
+	case PacketIn:
+		line := encodePacket(inp.Buf)
+		tx.Write(append(line, []byte(".v\n")...))
+	case ForthIn: // send forth source block to uC with flow-control and no echo
+		release := sw.hold(inp.From, "forth upload")
+		// We need to feed line-by-line to the output 'cause we need
+		// to read input, match it, and thereby rate-limit.
+		m := &matcher{Rx: sw.MicroInput, Out: &consoleWriter{sw}}
+		for i, line := range bytes.Split(inp.Buf, []byte{'\n'}) {
+			line = bytes.TrimRight(line, "\r")
+			if len(line) == 0 {
+				continue
 			}
-			if inp.Buf != nil {
-				putBuffer(inp.Buf)
+			tx.Write(line)
+			tx.Write([]byte{'\n'})
+			if !m.match(string(line), time.Now()) {
+				notify(inp.Reply, "forth upload failed at line %d", i+1)
+				err = fmt.Errorf("forth upload failed at line %d", i+1)
+				break
 			}
 		}
+		release()
+	}
+	if inp.Buf != nil {
+		putBuffer(inp.Buf)
 	}
 }
 
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -61,7 +62,7 @@ func (tc *TelnetConn) Open() error {
 			return fmt.Errorf("%s: %s", tc.Addr, err)
 		}
 	} else {
-		if tc.intPath == "" {
+		if !strings.HasPrefix(tc.intPath, byIDPrefix) {
 			tc.intPath = switchDev(tc.Path)
 		}
 		conn, err = serial.Open(tc.intPath, &serial.Mode{BaudRate: 115200})
@@ -87,6 +88,16 @@ func (tc *TelnetConn) Open() error {
 // Close the connection.
 func (tc *TelnetConn) Close() error { return tc.conn.Close() }
 
+// WaitDevice waits for the serial device to reappear, see MicroHotplug. Remote serial ports are
+// not devices, they just get the timeout.
+func (tc *TelnetConn) WaitDevice(timeout time.Duration) {
+	if tc.Addr != "" {
+		time.Sleep(timeout)
+	} else {
+		waitDevice(tc.intPath, timeout)
+	}
+}
+
 // Read bytes from the connection.
 func (tc *TelnetConn) Read(buf []byte) (int, error) {
 	n, err := tc.conn.Read(buf)
@@ -0,0 +1,154 @@
+package folie
+
+// This file contains the Transcript, which logs all traffic through the switchboard to a file.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcriptKeep is how many rotated transcript files are kept around, as file.1, file.2, etc.
+const transcriptKeep = 3
+
+// LogSize is the size at which transcript files started with !log get rotated.
+var LogSize int64 = 10 << 20
+
+// Transcript is a Tap which writes a timestamped log of all traffic to a file, one line per
+// chunk of data. Each line shows the direction ('<' from the microcontroller, '>' to it, '*' for
+// events) and the source of the data. Once the file reaches MaxSize bytes it is rotated.
+type Transcript struct {
+	Path    string // name of the log file
+	MaxSize int64  // rotate when the file gets larger than this, 0 to never rotate
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+var _ Tap = &Transcript{} // ensure the interface is implemented
+
+// OpenTranscript opens (or appends to) a transcript log file.
+func OpenTranscript(path string, maxSize int64) (*Transcript, error) {
+	t := &Transcript{Path: path, MaxSize: maxSize}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// open opens the log file and determines its current size.
+func (t *Transcript) open() error {
+	f, err := os.OpenFile(t.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f, t.size = f, info.Size()
+	return nil
+}
+
+// Close closes the log file.
+func (t *Transcript) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
+
+// Tap writes one line to the log.
+func (t *Transcript) Tap(dir byte, src string, buf []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.f == nil {
+		return
+	}
+	if t.MaxSize > 0 && t.size >= t.MaxSize {
+		if err := t.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "\n[Error rotating %s: %s]\n", t.Path, err)
+			return
+		}
+	}
+
+	data := string(buf)
+	if dir != Event {
+		data = strings.Trim(fmt.Sprintf("%q", buf), `"`)
+	}
+	n, err := fmt.Fprintf(t.f, "%s %c %-12s %s\n",
+		time.Now().Format("2006-01-02 15:04:05.000"), dir, src, data)
+	t.size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\n[Error writing %s: %s]\n", t.Path, err)
+	}
+}
+
+// rotate renames the current log file to file.1, shifting older ones up, and starts a new one.
+func (t *Transcript) rotate() error {
+	t.f.Close()
+	t.f = nil
+	for i := transcriptKeep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", t.Path, i), fmt.Sprintf("%s.%d", t.Path, i+1))
+	}
+	if err := os.Rename(t.Path, t.Path+".1"); err != nil {
+		return err
+	}
+	return t.open()
+}
+
+// OpenLog starts logging all traffic to a transcript file, replacing any previous one.
+func (sw *Switchboard) OpenLog(path string, maxSize int64) error {
+	t, err := OpenTranscript(path, maxSize)
+	if err != nil {
+		return err
+	}
+	sw.CloseLog()
+	sw.transcript = t
+	sw.AddTap(t)
+	return nil
+}
+
+// CloseLog stops logging traffic to the transcript file.
+func (sw *Switchboard) CloseLog() {
+	if sw.transcript != nil {
+		sw.RemoveTap(sw.transcript)
+		sw.transcript.Close()
+		sw.transcript = nil
+	}
+}
+
+// wrappedLog implements the !log command.
+func (sw *Switchboard) wrappedLog(argv []string, out io.Writer) {
+	var args []string
+	if len(argv) > 1 {
+		args = strings.Fields(argv[1])
+	}
+	switch {
+	case len(args) == 0:
+		if sw.transcript == nil {
+			fmt.Fprintln(out, "Not logging.")
+		} else {
+			fmt.Fprintf(out, "Logging to %s\n", sw.transcript.Path)
+		}
+	case args[0] == "off" && len(args) == 1:
+		sw.CloseLog()
+	case args[0] == "on" && len(args) == 2:
+		if err := sw.OpenLog(args[1], LogSize); err != nil {
+			fmt.Fprintln(out, err)
+		}
+	default:
+		fmt.Fprintf(out, "Usage: %s on <file> | off\n", argv[0])
+	}
+}
@@ -1,6 +1,8 @@
 package folie
 
 import (
+	"bytes"
+	"debug/elf"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -29,6 +31,7 @@ type Uploader struct {
 	Tx     MicroConn
 	Rx     <-chan []byte
 	Stdout io.Writer
+	Failed bool // set if the target did not acknowledge a command
 
 	checkSum byte   // upload protocol checksum
 	pending  []byte // data received while waiting for line echo
@@ -37,8 +40,16 @@ type Uploader struct {
 
 // Uploader implements the STM32 usart boot protocol to upload new firmware.
 func (u *Uploader) Upload(data []byte) {
-	// convert to binary if first few bytes look like they are in "ihex" format
-	if len(data) > 11 && data[0] == ':' {
+	// convert to binary if it is in ELF format, or if the first few bytes look like "ihex"
+	if bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		bin, err := elfToBin(data)
+		if err != nil {
+			fmt.Fprintln(u.Stdout, "Not a usable ELF file:", err)
+			u.Failed = true
+			return
+		}
+		data = bin
+	} else if len(data) > 11 && data[0] == ':' {
 		_, err := hex.DecodeString(string(data[1:11]))
 		if err == nil {
 			data = u.hexToBin(data)
@@ -135,6 +146,7 @@ func (u *Uploader) wantAck(retries int) {
 	}
 	if r != ACK {
 		fmt.Fprintf(u.Stdout, "\nFailed: %02X\n", r)
+		u.Failed = true
 	}
 	u.checkSum = 0
 }
@@ -271,3 +283,50 @@ func (u *Uploader) hexToBin(data []byte) []byte {
 	}
 	return bin
 }
+
+// Where firmware images go, uploads are written to flash starting at its base address.
+const (
+	flashBase    = 0x08000000
+	maxFlashSize = 2 << 20 // largest flash of the supported microcontrollers
+)
+
+// elfToBin converts an ELF executable to binary, by laying out its loadable segments at their
+// physical addresses, relative to the start of flash. Segments outside of flash, such as the
+// initial contents of RAM, are skipped. Gaps are filled with 0xFF, like erased flash. Images
+// which don't fit in flash are rejected.
+func elfToBin(data []byte) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var progs []*elf.Prog
+	size := uint64(0)
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Filesz == 0 || p.Paddr < flashBase {
+			continue
+		}
+		offset := p.Paddr - flashBase
+		if offset >= maxFlashSize {
+			continue
+		}
+		if p.Filesz > maxFlashSize-offset {
+			return nil, fmt.Errorf("image larger than %d KB of flash", maxFlashSize>>10)
+		}
+		progs = append(progs, p)
+		if offset+p.Filesz > size {
+			size = offset + p.Filesz
+		}
+	}
+	if len(progs) == 0 {
+		return nil, fmt.Errorf("no loadable segments in flash")
+	}
+
+	bin := bytes.Repeat([]byte{0xFF}, int(size))
+	for _, p := range progs {
+		offset := p.Paddr - flashBase
+		if _, err := p.ReadAt(bin[offset:offset+p.Filesz], 0); err != nil {
+			return nil, err
+		}
+	}
+	return bin, nil
+}
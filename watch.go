@@ -0,0 +1,198 @@
+package folie
+
+// This file implements !watch, which re-sends a forth source file whenever it changes.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watcher tracks a top-level source file plus everything it includes and re-sends it whenever
+// any of those files changes. The watching happens in a goroutine, the re-sending is queued up
+// as a job for the switchboard so it doesn't collide with other traffic to the microcontroller.
+type watcher struct {
+	file   string // top-level file, absolute path
+	before string // "reset", a forget word to execute before re-sending, or empty
+
+	fsw   *fsnotify.Watcher
+	mu    sync.Mutex      // protects files
+	files map[string]bool // absolute paths of all the files pulled in by file
+}
+
+// wrappedWatch implements the !watch command.
+func (sw *Switchboard) wrappedWatch(argv []string, out io.Writer) {
+	var args []string
+	if len(argv) > 1 {
+		args = strings.Fields(argv[1])
+	}
+
+	switch {
+	case len(args) == 0:
+		if sw.watch == nil {
+			fmt.Fprintln(out, "Not watching anything.")
+		} else {
+			fmt.Fprintf(out, "Watching %s (%d files)\n", sw.watch.file, sw.watch.count())
+		}
+		return
+	case args[0] == "off":
+		if sw.watch != nil {
+			sw.watch.fsw.Close()
+			sw.watch = nil
+		}
+		return
+	case len(args) > 2:
+		fmt.Fprintf(out, "Usage: %s <filename> [reset|<forget-word>]\n", argv[0])
+		return
+	}
+
+	file, err := filepath.Abs(args[0])
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return
+	}
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return
+	}
+	if sw.watch != nil {
+		sw.watch.fsw.Close()
+	}
+	w := &watcher{file: file, fsw: fsw}
+	if len(args) > 1 {
+		w.before = args[1]
+	}
+	if err := w.update(); err != nil {
+		fsw.Close()
+		fmt.Fprintln(out, err)
+		return
+	}
+	sw.watch = w
+	go w.run(sw.jobs, func() { sw.resend(w) })
+
+	fmt.Fprintf(out, "Watching %s (%d files), \"!watch off\" to stop.\n", file, w.count())
+}
+
+// update expands the top-level file to find out which files it pulls in and watches the
+// directories they are in. Directories are watched rather than the files themselves because
+// many editors save by writing a new file and renaming it.
+func (w *watcher) update() error {
+	in := &Includer{Tx: ioutil.Discard, DryRun: true}
+	in.Include(w.file)
+	if len(in.Files) == 0 {
+		return fmt.Errorf("cannot watch %s", w.file)
+	}
+
+	files := map[string]bool{}
+	for _, name := range in.Files {
+		if abs, err := filepath.Abs(name); err == nil {
+			files[abs] = true
+			if err := w.fsw.Add(filepath.Dir(abs)); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = files
+	return nil
+}
+
+// matches returns true if the named file is one of the watched ones.
+func (w *watcher) matches(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.files[filepath.Clean(name)]
+}
+
+// count returns the number of watched files.
+func (w *watcher) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.files)
+}
+
+// run waits for changes and then queues up a resend. Changes are collected until things have
+// been quiet for a bit, since saving a file often produces several events in a row.
+func (w *watcher) run(jobs chan<- func(), resend func()) {
+	var settled <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return // watcher has been closed
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 && w.matches(ev.Name) {
+				settled = time.After(200 * time.Millisecond)
+			}
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("[watch: %s]\n", err)
+		case <-settled:
+			settled = nil
+			jobs <- resend
+		}
+	}
+}
+
+// resend prepares the microcontroller and sends the watched file again. It runs as a job in the
+// switchboard's goroutine.
+func (sw *Switchboard) resend(w *watcher) {
+	if sw.watch != w {
+		return // the watch was stopped or replaced while this job was queued
+	}
+	name := filepath.Base(w.file)
+	if owner := sw.owner(); owner != "" && owner != ConsoleSrc {
+		fmt.Printf("[watch: %s changed, not sent: locked by %s]\n", name, owner)
+		return
+	}
+	fmt.Printf("[watch: %s changed]\n", name)
+	defer sw.hold(ConsoleSrc, "watch")()
+
+	tx := sw.to("watch")
+	switch w.before {
+	case "":
+	case "reset":
+		tx.Reset(false)
+		sw.drainMicro(500 * time.Millisecond)
+	default:
+		tx.Write([]byte(w.before + "\r"))
+		(&matcher{Rx: sw.MicroInput}).match(w.before, time.Now())
+	}
+
+	in := &Includer{Tx: tx, Rx: sw.MicroInput}
+	if sw.include(in, w.file, "watch") {
+		fmt.Printf("[watch: %s ok, %s]\n", name, in.Stats())
+	} else {
+		fmt.Printf("[watch: %s FAILED, %s]\n", name, in.Stats())
+	}
+
+	// The set of included files may have changed.
+	if err := w.update(); err != nil {
+		fmt.Printf("[watch: %s]\n", err)
+	}
+}
+
+// drainMicro shows everything coming from the microcontroller until it has been quiet for the
+// specified time, for example to let a reset banner pass by.
+func (sw *Switchboard) drainMicro(quiet time.Duration) {
+	for {
+		select {
+		case buf := <-sw.MicroInput:
+			sw.consoleWrite(buf)
+			putBuffer(buf)
+		case <-time.After(quiet):
+			return
+		}
+	}
+}
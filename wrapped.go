@@ -3,7 +3,9 @@ package folie
 // This file contains !commands.
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -11,45 +13,114 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// The functions in this file are only called in the context of interactive console input and they
-// all print directly to stdout. This is OK in this context, but may have to be changed in the
-// future if we want to support a remote interactive console. Not clear there is a need for that.
+// The functions in this file are called in the context of interactive console input, either from
+// the local console or from a remote SSH shell session. They print to the output of the client
+// which issued the command, see cmdClient.
+
+// cmdClient describes who issued a ! command.
+type cmdClient struct {
+	Src  string    // who sent the command, see ConsoleSrc
+	Out  io.Writer // where the output of the command goes
+	Role Role      // what the client is permitted to do
+}
+
+// localClient returns the cmdClient for the local interactive console. Stdout is looked up on
+// each call since readline replaces it.
+func localClient() *cmdClient {
+	return &cmdClient{Src: ConsoleSrc, Out: os.Stdout, Role: RoleAdmin}
+}
+
+// reply returns where notices for the client go, see notify.
+func (c *cmdClient) reply() io.Writer {
+	if c.Src == ConsoleSrc {
+		return nil
+	}
+	return c.Out
+}
 
 // specialCommand recognises and handles certain commands in a different way.
-func (sw *Switchboard) specialCommand(line string) bool {
+func (sw *Switchboard) specialCommand(line string, c *cmdClient) bool {
 	cmd := strings.SplitN(line, " ", 2)
+	if need := commandRole(cmd[0]); c.Role < need {
+		notify(c.reply(), "permission denied, %s role required", need)
+		return true
+	}
 	switch cmd[0] {
 	case "!":
-		fmt.Println("[enter '!h' for help]")
+		fmt.Fprintln(c.Out, "[enter '!h' for help]")
 
 	case "!c", "!cd":
-		fmt.Println(line)
-		wrappedCd(cmd)
+		fmt.Fprintln(c.Out, line)
+		wrappedCd(cmd, c.Out)
 
 	case "!h", "!help":
-		fmt.Println(line)
-		showHelp()
+		fmt.Fprintln(c.Out, line)
+		showHelp(c.Out)
+		sw.showMacros(c)
+		if c.Src == ConsoleSrc {
+			showKeys(c.Out)
+		}
 
 	case "!l", "!ls":
-		fmt.Println(line)
-		wrappedLs(cmd)
+		fmt.Fprintln(c.Out, line)
+		wrappedLs(cmd, c.Out)
+
+	case "!lock", "!unlock":
+		fmt.Fprintln(c.Out, line)
+		sw.wrappedLock(cmd, c)
+
+	case "!log":
+		fmt.Fprintln(c.Out, line)
+		sw.wrappedLog(cmd, c.Out)
 
 	case "!r", "!reset":
-		fmt.Println(line)
-		sw.wrappedReset()
+		fmt.Fprintln(c.Out, line)
+		if sw.allowed(c.Src, c.reply()) {
+			sw.wrappedReset(c)
+		}
 
 	case "!s", "!send":
-		fmt.Println(line)
-		sw.wrappedSend(cmd)
+		fmt.Fprintln(c.Out, line)
+		if sw.allowed(c.Src, c.reply()) {
+			defer sw.hold(c.Src, "send")()
+			sw.wrappedSend(cmd, c)
+		}
 
 	case "!u", "!upload":
-		fmt.Println(line)
-		sw.wrappedUpload(cmd)
+		fmt.Fprintln(c.Out, line)
+		if sw.allowed(c.Src, c.reply()) {
+			defer sw.hold(c.Src, "upload")()
+			sw.wrappedUpload(cmd, c)
+		}
+
+	case "!run":
+		fmt.Fprintln(c.Out, line)
+		if sw.allowed(c.Src, c.reply()) {
+			defer sw.hold(c.Src, "script")()
+			sw.wrappedRun(cmd, c)
+		}
+
+	case "!script":
+		fmt.Fprintln(c.Out, line)
+		sw.wrappedScript(cmd, c)
+
+	case "!w", "!watch":
+		fmt.Fprintln(c.Out, line)
+		sw.wrappedWatch(cmd, c.Out)
 
 	default:
-		return false
+		lines := sw.Macros[strings.TrimPrefix(cmd[0], "!")]
+		if lines == nil {
+			return false
+		}
+		fmt.Fprintln(c.Out, line)
+		if sw.allowed(c.Src, c.reply()) {
+			defer sw.hold(c.Src, "macro")()
+			sw.wrappedMacro(cmd, lines, c)
+		}
 	}
 	return true
 }
@@ -58,36 +129,48 @@ const helpMsg = `
 Special commands, these can also be abbreviated as "!r", etc:
   !reset          reset the board, same as ctrl-c
   !send <file>    send text file to the serial port, expand "include" lines
+  !send           send the same file again
+  !send -n <file> show expanded file without sending, add <out> to save it,
+                  add -m before <file> to mark the origin of each line
+  !watch <file>   re-send file whenever it or one of its includes changes,
+                  add "reset" or a forget word to run that first, "off" to stop
   !upload         show the list of built-in firmware images
   !upload <n>     upload built-in image <n> using STM32 boot protocol
-  !upload <file>  upload specified firmware image (bin or hex format)
+  !upload 0       upload the default firmware of the config file profile
+  !upload <file>  upload specified firmware image (bin, hex, or elf format)
   !upload <url>   fetch firmware image from given URL, then upload it
+  !run <script>   run a script, e.g. to reset, send a file, and check the output
+  !script <file>  start a Starlark script in the background, "!script" lists
+                  the running ones, "!script stop <n>" stops one
+Sharing with remote clients:
+  !lock           make all other clients read-only, "!unlock" to release
 Utility commands:
+  !log on <file>  log all traffic with timestamps to file, "!log off" to stop
   !cd <dir>       change directory (or list current one if not specified)
   !ls <dir>       list contents of the specified (or current) directory
   !help           this message
 To quit, hit ctrl-d. For command history, use up-/down-arrow.
 `
 
-func showHelp() {
-	fmt.Print(helpMsg[1:])
+func showHelp(out io.Writer) {
+	fmt.Fprint(out, helpMsg[1:])
 }
 
-func wrappedCd(argv []string) {
+func wrappedCd(argv []string, out io.Writer) {
 	if len(argv) > 1 {
 		if err := os.Chdir(argv[1]); err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(out, err)
 			return
 		}
 	}
 	if dir, err := os.Getwd(); err == nil {
-		fmt.Println(dir)
+		fmt.Fprintln(out, dir)
 	} else {
-		fmt.Println(err)
+		fmt.Fprintln(out, err)
 	}
 }
 
-func wrappedLs(argv []string) {
+func wrappedLs(argv []string, out io.Writer) {
 	dir := "."
 	if len(argv) > 1 {
 		dir = argv[1]
@@ -103,23 +186,96 @@ func wrappedLs(argv []string) {
 			names = append(names, n)
 		}
 	}
-	fmt.Println(strings.Join(names, " "))
+	fmt.Fprintln(out, strings.Join(names, " "))
 }
 
-func (sw *Switchboard) wrappedReset() {
-	if ok := sw.MicroOutput.Reset(false); !ok {
+func (sw *Switchboard) wrappedReset(c *cmdClient) {
+	if ok := sw.to(c.Src).Reset(false); !ok {
 		// Couldn't perform the reset, probably error on serial/telnet.
-		fmt.Println("[use CTRL-D to exit]")
+		fmt.Fprintln(c.Out, "[use CTRL-D to exit]")
 	}
 }
 
-func (sw *Switchboard) wrappedSend(argv []string) {
+func (sw *Switchboard) wrappedSend(argv []string, c *cmdClient) {
+	if len(argv) > 1 && (argv[1] == "-n" || strings.HasPrefix(argv[1], "-n ")) {
+		wrappedExpand(strings.Fields(argv[1])[1:], c.Out)
+		return
+	}
 	if len(argv) == 1 {
-		fmt.Printf("Usage: %s <filename>\n", argv[0])
+		if sw.lastSend == "" {
+			fmt.Fprintf(c.Out, "Usage: %s <filename>\n", argv[0])
+			return
+		}
+		argv = append(argv, sw.lastSend)
+	}
+	sw.lastSend = argv[1]
+	in := &Includer{Tx: sw.to(c.Src), Rx: sw.MicroInput, Stdout: c.Out}
+	if !sw.include(in, argv[1], c.Src) {
+		fmt.Fprintln(c.Out, "Send failed.")
+	}
+	fmt.Fprintf(c.Out, "[%s]\n", in.Stats())
+}
+
+// include sends a file and everything it includes using in on behalf of src. If the
+// microcontroller is remote, the source is expanded locally and then shipped as a whole to be
+// sent by the other end.
+func (sw *Switchboard) include(in *Includer, name, src string) bool {
+	return sw.includeFunc(in, src, func() bool { return in.Include(name) })
+}
+
+// includeFunc is like include, but the source is sent by calling send, which uses in.
+func (sw *Switchboard) includeFunc(in *Includer, src string, send func() bool) bool {
+	fo, ok := sw.MicroOutput.(MicroForther)
+	if !ok {
+		return send()
+	}
+
+	start := time.Now()
+	var code bytes.Buffer
+	tx := in.Tx
+	in.Tx, in.DryRun = &code, true
+	ok = send()
+	in.Tx, in.DryRun = tx, false
+	if !ok {
+		return false
+	}
+
+	sw.tap(Event, src, []byte(fmt.Sprintf("forth %d bytes", code.Len())))
+	in.Bytes = code.Len()
+	defer func() { in.Elapsed = time.Since(start) }()
+
+	// Keep showing output while the remote end is busy, it must not get stuck sending it to us.
+	done := make(chan bool)
+	go func() { done <- fo.Forth(code.Bytes()) }()
+	for {
+		select {
+		case buf := <-sw.MicroInput:
+			sw.consoleWrite(buf)
+			putBuffer(buf)
+		case ok := <-done:
+			return ok
+		}
+	}
+}
+
+// wrappedExpand performs a dry run of !send, writing the expanded source to out or a file.
+func wrappedExpand(args []string, out io.Writer) {
+	origin := len(args) > 0 && args[0] == "-m"
+	if origin {
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(out, "Usage: !send -n [-m] <filename> [<outfile>]")
 		return
 	}
-	if !includeFile(sw.MicroOutput, sw.MicroInput, argv[1], 0) { // FIXME: need tx channel
-		fmt.Println("Send failed.")
+	var err error
+	if len(args) > 1 {
+		err = ExpandFile(args[0], args[1], origin)
+	} else {
+		err = expand(args[0], out, origin)
+	}
+	if err != nil {
+		fmt.Fprintln(out, err)
 	}
 }
 
@@ -137,40 +293,47 @@ func crc16(data []byte) uint16 {
 	return crc
 }
 
-func (sw *Switchboard) wrappedUpload(argv []string) {
+func (sw *Switchboard) wrappedUpload(argv []string, c *cmdClient) {
 	names := sw.AssetNames
 	sort.Strings(names)
 
 	if len(argv) == 1 {
-		fmt.Println("These firmware images are built-in:")
+		if sw.Firmware != "" {
+			fmt.Fprintf(c.Out, "The default firmware is %s, use '!u 0' to upload it.\n", sw.Firmware)
+		}
+		fmt.Fprintln(c.Out, "These firmware images are built-in:")
 		for i, name := range names {
 			data, _ := sw.Asset(name)
-			fmt.Printf("%3d: %-16s %5db  crc:%04X\n",
+			fmt.Fprintf(c.Out, "%3d: %-16s %5db  crc:%04X\n",
 				i+1, name, len(data), crc16(data))
 		}
-		fmt.Println("Use '!u <n>' to upload a specific one.")
+		fmt.Fprintln(c.Out, "Use '!u <n>' to upload a specific one.")
 		return
 	}
 
+	if argv[1] == "0" && sw.Firmware != "" {
+		argv = []string{argv[0], sw.Firmware}
+	}
+
 	// try built-in images first, indicated by entering a valid number
 	var data []byte
 	if n, err := strconv.Atoi(argv[1]); err == nil && 0 < n && n <= len(names) {
 		data, _ = sw.Asset(names[n-1])
 	} else if u, err := url.Parse(argv[1]); err == nil && u.Scheme != "" {
-		fmt.Print("Fetching... ")
+		fmt.Fprint(c.Out, "Fetching... ")
 		res, err := http.Get(argv[1])
 		if err == nil {
 			data, err = ioutil.ReadAll(res.Body)
 			res.Body.Close()
 		}
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(c.Out, err)
 			return
 		}
 		if res.StatusCode < 200 || res.StatusCode >= 300 {
-			fmt.Printf("%s: %s\n", res.Status, string(data))
+			fmt.Fprintf(c.Out, "%s: %s\n", res.Status, string(data))
 		}
-		fmt.Printf("got it, crc:%04X\n", crc16(data))
+		fmt.Fprintf(c.Out, "got it, crc:%04X\n", crc16(data))
 	} else { // else try opening the arg as file
 		f, err := os.Open(argv[1])
 		if err == nil {
@@ -178,21 +341,77 @@ func (sw *Switchboard) wrappedUpload(argv []string) {
 			f.Close()
 		}
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(c.Out, err)
 			return
 		}
 	}
 
+	sw.flash(data, c.Src)
+}
+
+// flash uploads firmware on behalf of src and then resets the microcontroller to start it. It
+// returns false if the upload failed.
+func (sw *Switchboard) flash(data []byte, src string) bool {
+	sw.tap(Event, src, []byte(fmt.Sprintf("flash %d bytes", len(data))))
 	if fl, ok := sw.MicroOutput.(MicroFlasher); ok {
 		// The MicroOutput implements a special flashing method. Call it!
 		// This is primarily the case for a remote SSH connection: it sends the bytes
 		// to the remote end to play the flashing game there.
-		fl.Flash(data)
+		if !fl.Flash(data) {
+			return false
+		}
 	} else {
 		// We get to perform the flashing algorithm here...
-		defer sw.MicroOutput.Reset(false) // reset with BOOT0 low to restart normally
-
 		u := &Uploader{Tx: sw.MicroOutput, Rx: sw.MicroInput, Stdout: &consoleWriter{sw}}
 		u.Upload(data)
+		sw.to(src).Reset(false) // reset with BOOT0 low to restart normally
+		if u.Failed {
+			return false
+		}
+	}
+	sw.queueHook("upload", sw.Hooks.Upload)
+	return true
+}
+
+// wrappedRun implements the !run command.
+func (sw *Switchboard) wrappedRun(argv []string, c *cmdClient) {
+	if len(argv) == 1 {
+		fmt.Fprintf(c.Out, "Usage: %s <script>\n", argv[0])
+		return
+	}
+	s := &Script{Tx: sw.to(c.Src), Rx: sw.MicroInput, Out: c.Out}
+	s.Include = func(name string) bool {
+		in := &Includer{Tx: s.Tx, Rx: sw.MicroInput, Stdout: c.Out}
+		return sw.include(in, name, c.Src)
+	}
+	s.Upload = func(data []byte) bool { return sw.flash(data, c.Src) }
+	if err := s.RunFile(argv[1]); err != nil {
+		fmt.Fprintf(c.Out, "[script failed: %s]\n", err)
+		return
+	}
+	fmt.Fprintln(c.Out, "[script done]")
+}
+
+// wrappedScript implements the !script command.
+func (sw *Switchboard) wrappedScript(argv []string, c *cmdClient) {
+	if sw.Scripts == nil {
+		fmt.Fprintln(c.Out, "Starlark scripts are not available.")
+		return
+	}
+	if len(argv) == 1 {
+		sw.Scripts.List(c.Out)
+		return
+	}
+	args := strings.Fields(argv[1])
+	switch {
+	case len(args) == 2 && args[0] == "stop":
+		id, err := strconv.Atoi(args[1])
+		if err != nil || !sw.Scripts.Stop(id) {
+			fmt.Fprintf(c.Out, "No such script: %s\n", args[1])
+		}
+	case len(args) == 1:
+		sw.Scripts.Start(args[0], sw.Scripts.Boards.of(sw), c.Role)
+	default:
+		fmt.Fprintf(c.Out, "Usage: %s [<file> | stop <n>]\n", argv[0])
 	}
 }